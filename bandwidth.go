@@ -0,0 +1,55 @@
+package dctk
+
+// speed advertised to hubs when uploads are not limited
+const uploadAdvertisedSpeed = 2 * 1024 * 1024
+
+// advertisedUploadSpeed returns the upload speed that is sent to hubs.
+func (c *Client) advertisedUploadSpeed() uint {
+	if c.conf.UploadMaxSpeed != 0 {
+		return c.conf.UploadMaxSpeed
+	}
+	return uploadAdvertisedSpeed
+}
+
+// SetUploadMaxSpeed changes the maximum speed of all uploads, in bytes per second.
+// Zero means no limit.
+func (c *Client) SetUploadMaxSpeed(speed uint) {
+	c.conf.UploadMaxSpeed = speed
+	c.uploadLimiter.setRate(uint64(speed))
+
+	// the upload speed is part of the informations sent to hubs
+	for _, h := range c.hubs {
+		if h.state == hubInitialized {
+			h.sendInfos(false)
+		}
+	}
+}
+
+// SetDownloadMaxSpeed changes the maximum speed of all downloads, in bytes per second.
+// Zero means no limit.
+func (c *Client) SetDownloadMaxSpeed(speed uint) {
+	c.conf.DownloadMaxSpeed = speed
+	c.downloadLimiter.setRate(uint64(speed))
+}
+
+// SetUploadMaxSpeedPerPeer changes the maximum speed of uploads to a single
+// peer, in bytes per second. Zero means no limit.
+func (c *Client) SetUploadMaxSpeedPerPeer(speed uint) {
+	c.conf.UploadMaxSpeedPerPeer = speed
+	for p := range c.peerConns {
+		if _, ok := p.transfer.(*Upload); ok {
+			p.limiter.setRate(uint64(speed))
+		}
+	}
+}
+
+// SetDownloadMaxSpeedPerPeer changes the maximum speed of downloads from a
+// single peer, in bytes per second. Zero means no limit.
+func (c *Client) SetDownloadMaxSpeedPerPeer(speed uint) {
+	c.conf.DownloadMaxSpeedPerPeer = speed
+	for p := range c.peerConns {
+		if _, ok := p.transfer.(*Download); ok {
+			p.limiter.setRate(uint64(speed))
+		}
+	}
+}
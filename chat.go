@@ -8,29 +8,39 @@ import (
 	"github.com/aler9/dctk/pkg/protoadc"
 )
 
-// MessagePublic publishes a message in the hub public chat.
+// MessagePublic publishes a message in the public chat of every connected hub.
 func (c *Client) MessagePublic(content string) {
-	if c.protoIsAdc() {
-		c.hubConn.conn.Write(&protoadc.AdcBMessage{ //nolint:govet
-			&adc.BroadcastPacket{ID: c.adcSessionID},
+	for _, h := range c.hubs {
+		if h.state == hubInitialized {
+			h.MessagePublic(content)
+		}
+	}
+}
+
+// MessagePublic publishes a message in the hub public chat.
+func (h *Hub) MessagePublic(content string) {
+	if h.protoIsAdc() {
+		h.conn.Write(&protoadc.AdcBMessage{ //nolint:govet
+			&adc.BroadcastPacket{ID: h.adcSessionID},
 			&adc.ChatMessage{Text: content},
 		})
 	} else {
-		c.hubConn.conn.Write(&nmdc.ChatMessage{c.conf.Nick, content}) //nolint:govet
+		h.conn.Write(&nmdc.ChatMessage{h.nick, content}) //nolint:govet
 	}
 }
 
-// MessagePrivate sends a private message to a specific peer connected to the hub.
+// MessagePrivate sends a private message to a specific peer connected to a hub.
 func (c *Client) MessagePrivate(dest *Peer, content string) {
-	if c.protoIsAdc() {
-		c.hubConn.conn.Write(&protoadc.AdcDMessage{ //nolint:govet
-			&adc.DirectPacket{ID: c.adcSessionID, To: dest.adcSessionID},
+	h := dest.Hub
+	if h.protoIsAdc() {
+		h.conn.Write(&protoadc.AdcDMessage{ //nolint:govet
+			&adc.DirectPacket{ID: h.adcSessionID, To: dest.adcSessionID},
 			&adc.ChatMessage{Text: content},
 		})
 	} else {
-		c.hubConn.conn.Write(&nmdc.PrivateMessage{
-			From: c.conf.Nick,
-			Name: c.conf.Nick,
+		h.conn.Write(&nmdc.PrivateMessage{
+			From: h.nick,
+			Name: h.nick,
 			To:   dest.Nick,
 			Text: content,
 		})
@@ -14,10 +14,9 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"regexp"
+	"runtime"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/aler9/go-dc/adc"
@@ -75,24 +74,69 @@ type ClientConf struct {
 	// the maximum number of file to download in parallel. When this number is
 	// exceeded, the other downloads are queued and started when a slot becomes available
 	DownloadMaxParallel uint
+	// the maximum speed of all downloads, in bytes per second.
+	// It defaults to zero, that means no limit
+	DownloadMaxSpeed uint
+	// the maximum speed of downloads from a single peer, in bytes per second.
+	// It defaults to zero, that means no limit
+	DownloadMaxSpeedPerPeer uint
+	// (optional) the path of a file in which the download queue is saved.
+	// The queue is reloaded from it when the client is created
+	QueueFile string
+	// (optional) the path of a file in which the favorite users are saved.
+	// The list is reloaded from it when the client is created
+	FavoritesFile string
 	// the maximum number of file to upload in parallel
 	UploadMaxParallel uint
+	// the number of additional slots that are reserved to file lists, TTH leaves
+	// and files smaller than UploadMiniSlotSize. It defaults to 3
+	UploadMiniSlots uint
+	// the maximum size of files that can be uploaded with mini-slots.
+	// It defaults to 64 KiB
+	UploadMiniSlotSize uint64
+	// disables mini-slots
+	UploadDisableMiniSlots bool
+	// when upload slots are full, peers are put in a queue and receive a slot
+	// in order of arrival when they request again. This is the period after
+	// which peers that did not request again are removed from the queue.
+	// It defaults to 3 minutes
+	UploadQueueTimeout time.Duration
 
 	// set the policy regarding encryption with other peers. See EncryptionMode for options
 	PeerEncryptionMode EncryptionMode
 
-	// The hub url in the format protocol://address:port
-	// supported protocols are adc, adcs, nmdc and nmdcs
+	// (optional) the url of a hub to connect to, in the format protocol://address:port.
+	// Supported protocols are adc, adcs, nmdc and nmdcs. Other hubs can be
+	// added with HubAdd()
 	HubURL string
 	// how many times attempting a connection with hub before giving up
 	HubConnTries uint
-	// if turned on, connection to hub is not automatic and HubConnect() must be
+	// if turned on, the connection with a hub is restored automatically when
+	// it is lost, instead of removing the hub. The client is closed when there
+	// are no hubs left
+	HubReconnect bool
+	// how many times attempting a reconnection with the hub before giving up and
+	// removing the hub. Leave zero to attempt indefinitely
+	HubReconnectMaxTries uint
+	// the delay before the first reconnection attempt. It is doubled after
+	// every failed attempt, up to HubReconnectMaxDelay
+	HubReconnectMinDelay time.Duration
+	HubReconnectMaxDelay time.Duration
+	// the fraction of the delay (between 0 and 1) that is randomly added or
+	// subtracted to it, to avoid reconnecting together with other clients
+	HubReconnectJitter float64
+	// if turned on, redirects sent by hubs (NMDC ForceMove, ADC QUI with RD)
+	// are followed, by connecting to the new address
+	FollowRedirects bool
+	// how many consecutive redirects are followed before giving up. It defaults to 3
+	RedirectLimit uint
+	// if turned on, connection to hubs is not automatic and HubConnect() must be
 	// called manually
 	HubManualConnect bool
 
-	// the nickname to use in the hub and with other peers
+	// the nickname to use in hubs and with other peers
 	Nick string
-	// the password associated with the nick, if requested by the hub
+	// the password associated with the nick, if requested by the hub in HubURL
 	Password string
 	// the private ID of the user (ADC only)
 	PID atypes.PID
@@ -100,8 +144,32 @@ type ClientConf struct {
 	Email string
 	// a description, optional
 	Description string
-	// the maximum upload speed in bytes/sec. It is not really applied, but is sent to the hub
+	// the maximum speed of all uploads, in bytes per second. It is also sent
+	// to hubs. It defaults to zero, that means no limit
 	UploadMaxSpeed uint
+	// the maximum speed of uploads to a single peer, in bytes per second.
+	// It defaults to zero, that means no limit
+	UploadMaxSpeedPerPeer uint
+	// (optional) a directory in which the hashes of shared files are saved, in
+	// order not to compute them again when the client is restarted. When used,
+	// TTH leaves are read from this directory instead of being kept in RAM
+	ShareCacheDir string
+	// whether to watch shared directories and update the share when files are
+	// created, modified, renamed or deleted. It is supported on Linux only
+	ShareWatch bool
+	// the number of files that are hashed in parallel when indexing the share.
+	// It defaults to the number of CPUs
+	ShareHashWorkers uint
+	// the maximum speed at which shared files are read when hashing them,
+	// in bytes per second. It defaults to zero, that means no limit
+	ShareHashMaxSpeed uint64
+	// the minimum interval between two searches sent to the same hub. Searches
+	// performed in the meanwhile are queued, and identical queued searches are
+	// merged. It defaults to zero, that means that searches are sent immediately
+	SearchMinInterval time.Duration
+	// the maximum number of incoming searches that are answered for every
+	// source (peer or address) in a minute. It defaults to 30
+	SearchIncomingMaxPerMinute uint
 	// these are used to identify the software. By default they mimic DC++
 	ClientString  string
 	ClientVersion string
@@ -114,80 +182,125 @@ type ClientConf struct {
 	HubDisableKeepAlive    bool
 }
 
-type protocolName uint32
-
-const (
-	protocolNMDC protocolName = iota
-	protocolADC
-)
-
 // Client represents a local client.
 type Client struct {
 	conf               ClientConf
 	mutex              sync.Mutex
 	wg                 sync.WaitGroup
-	proto              protocolName // atomic
+	started            bool
 	terminateRequested bool
 	terminate          chan struct{}
-	hubIsEncrypted     bool
-	hubHostname        string
-	hubPort            uint
-	hubSolvedIP        string
 	ip                 string
 	shareIndexer       *shareIndexer
-	shareRoots         map[string]string
+	hashCache          *hashCache
+	shareRoots         map[string]*shareRoot
 	shareTree          map[string]*shareDirectory
+	shareByTTH         map[tiger.Hash][]*shareFile
+	shareIndex         *shareNameIndex
 	shareCount         uint
 	shareSize          uint64
 	fileList           []byte
 	listenerTCP        *listenerTCP
 	tlsListener        *listenerTCP
 	listenerUDP        *listenerUDP
-	hubConn            *hubConn
+	hubs               []*Hub
 	// we follow the ADC way to handle IDs, even when using NMDC
 	privateID             atypes.PID
 	clientID              atypes.CID
-	adcSessionID          atypes.SID
 	adcFingerprint        string
-	peers                 map[string]*Peer
 	downloadSlotAvail     uint
 	uploadSlotAvail       uint
+	uploadMiniSlotAvail   uint
+	uploadQueue           []*UploadQueueEntry
+	favorites             []*FavoriteUser
+	grantedSlots          map[hubNickPair]time.Time
+	uploadLimiter         *rateLimiter
+	downloadLimiter       *rateLimiter
 	peerConns             map[*peerConn]struct{}
 	peerConnsByKey        map[nickDirectionPair]*peerConn
 	transfers             map[transfer]struct{}
-	activeDownloadsByPeer map[string]*Download
-
-	// OnInitialized is called just after client initialization, before connecting to the hub
+	activeDownloadsByPeer map[hubNickPair]*Download
+	multiSourceDownloads  map[*MultiSourceDownload]struct{}
+	searches              map[*SearchHandle]struct{}
+	searchSources         map[string]*searchIncomingSource
+	searchSourcesPruned   time.Time
+	searchStats           SearchStats
+	queue                 []*QueueItem
+	queueTimer            *time.Timer
+
+	// OnInitialized is called just after client initialization, before connecting to hubs
 	OnInitialized func()
 	// OnShareIndexed is called every time the share indexer has finished indexing the client share
-	OnShareIndexed func()
-	// OnHubConnected is called when the connection between client and hub has been established
-	OnHubConnected func()
+	OnShareIndexed func(summary ShareIndexSummary)
+	// OnShareIndexError is called when a file or directory of the client share can't be indexed
+	OnShareIndexError func(path string, err error)
+	// OnShareIndexProgress is called periodically while shared files are hashed
+	OnShareIndexProgress func(filesDone uint, filesTotal uint, bytesDone uint64, bytesTotal uint64)
+	// OnHubConnected is called when the connection between client and a hub has been established
+	OnHubConnected func(h *Hub)
 	// OnHubError is called when a critical error happens
-	OnHubError func(err error)
-	// OnHubInfo is called when an information about the hub is received
-	OnHubInfo func(field HubField, value string)
+	OnHubError func(h *Hub, err error)
+	// OnHubDisconnected is called when the connection with a hub is lost
+	OnHubDisconnected func(h *Hub, err error)
+	// OnHubReconnecting is called when a reconnection with a hub is scheduled,
+	// with the attempt number and the delay after which it will be performed
+	OnHubReconnecting func(h *Hub, attempt uint, delay time.Duration)
+	// OnHubRedirect is called when a hub redirects the client to another address
+	// and FollowRedirects is true. Return false to refuse the redirect
+	OnHubRedirect func(h *Hub, url string) bool
+	// OnHubInfo is called when an information about a hub is received
+	OnHubInfo func(h *Hub, field HubField, value string)
 	// OnHubTLS is called when a TLS connection with a hub is established
-	OnHubTLS func(st tls.ConnectionState)
-	// OnHubProto is called when a protocol for the hub is selected
-	OnHubProto func(proto string)
-	// OnPeerConnected is called when a peer connects to the hub
+	OnHubTLS func(h *Hub, st tls.ConnectionState)
+	// OnHubProto is called when a protocol for a hub is selected
+	OnHubProto func(h *Hub, proto string)
+	// OnPeerConnected is called when a peer connects to a hub
 	OnPeerConnected func(p *Peer)
 	// OnPeerUpdated is called when a peer has just updated its informations
 	OnPeerUpdated func(p *Peer)
-	// OnPeerDisconnected is called when a peer disconnects from the hub
+	// OnPeerDisconnected is called when a peer disconnects from a hub
 	OnPeerDisconnected func(p *Peer)
+	// OnFavoriteOnline is called when a favorite user connects to a hub
+	OnFavoriteOnline func(fav *FavoriteUser, p *Peer)
+	// OnFavoriteOffline is called when a favorite user disconnects from a hub
+	OnFavoriteOffline func(fav *FavoriteUser, p *Peer)
 	// OnMessagePublic is called when someone writes in the hub public chat.
 	// When using ADC, it is also called when the hub sends a message.
 	OnMessagePublic func(p *Peer, content string)
 	// OnMessagePrivate is called when a private message has been received
 	OnMessagePrivate func(p *Peer, content string)
-	// OnSearchResult is called when a search result has been received
+	// OnUserCommand is called when a hub provides a user command
+	OnUserCommand func(cmd *UserCommand)
+	// OnSearchResult is called when a search result has been received, for every search
 	OnSearchResult func(r *SearchResult)
 	// OnDownloadSuccessful is called when a given download has finished
 	OnDownloadSuccessful func(d *Download)
 	// OnDownloadError is called when a given download has failed
 	OnDownloadError func(d *Download)
+	// UploadAuthorizer, if set, is called when a peer requests an upload,
+	// and decides whether to allow it, deny it or put the peer in queue
+	UploadAuthorizer UploadAuthorizer
+	// OnUploadStarted is called when an upload to a peer starts
+	OnUploadStarted func(u *Upload)
+	// OnUploadProgress is called periodically during an upload
+	OnUploadProgress func(u *Upload)
+	// OnUploadFinished is called when an upload has finished
+	OnUploadFinished func(u *Upload)
+	// OnUploadError is called when an upload has failed
+	OnUploadError func(u *Upload, err error)
+	// OnQueueItemFinished is called when a queued file has been downloaded
+	// and removed from the queue
+	OnQueueItemFinished func(item *QueueItem)
+	// OnQueueItemError is called when the download of a queued file from a
+	// given peer has failed. The file remains in queue
+	OnQueueItemError func(item *QueueItem, p *Peer, err error)
+	// OnMultiSourceDownloadProgress is called periodically for every source of a
+	// multi-source download, with the amount of bytes received from it
+	OnMultiSourceDownloadProgress func(d *MultiSourceDownload, p *Peer, received uint64)
+	// OnMultiSourceDownloadSuccessful is called when a multi-source download has finished
+	OnMultiSourceDownloadSuccessful func(d *MultiSourceDownload)
+	// OnMultiSourceDownloadError is called when a multi-source download has failed
+	OnMultiSourceDownloadError func(d *MultiSourceDownload, err error)
 }
 
 // NewClient is used to initialize a client. See ClientConf for the available options.
@@ -212,15 +325,47 @@ func NewClient(conf ClientConf) (*Client, error) {
 	if conf.UploadMaxParallel == 0 {
 		conf.UploadMaxParallel = 10
 	}
+	if conf.UploadDisableMiniSlots {
+		conf.UploadMiniSlots = 0
+		conf.UploadMiniSlotSize = 0
+	} else {
+		if conf.UploadMiniSlots == 0 {
+			conf.UploadMiniSlots = 3
+		}
+		if conf.UploadMiniSlotSize == 0 {
+			conf.UploadMiniSlotSize = 64 * 1024
+		}
+	}
+	if conf.UploadQueueTimeout == 0 {
+		conf.UploadQueueTimeout = 3 * time.Minute
+	}
+	if conf.SearchIncomingMaxPerMinute == 0 {
+		conf.SearchIncomingMaxPerMinute = 30
+	}
+	if conf.ShareHashWorkers == 0 {
+		conf.ShareHashWorkers = uint(runtime.NumCPU())
+	}
 	if conf.HubConnTries == 0 {
 		conf.HubConnTries = 3
 	}
+	if conf.HubReconnectMinDelay == 0 {
+		conf.HubReconnectMinDelay = 5 * time.Second
+	}
+	if conf.HubReconnectMaxDelay == 0 {
+		conf.HubReconnectMaxDelay = 5 * time.Minute
+	}
+	if conf.HubReconnectMaxDelay < conf.HubReconnectMinDelay {
+		return nil, fmt.Errorf("hub reconnect max delay cannot be lower than min delay")
+	}
+	if conf.HubReconnectJitter < 0 || conf.HubReconnectJitter > 1 {
+		return nil, fmt.Errorf("hub reconnect jitter must be between 0 and 1")
+	}
+	if conf.RedirectLimit == 0 {
+		conf.RedirectLimit = 3
+	}
 	if conf.Nick == "" {
 		return nil, fmt.Errorf("nick is mandatory")
 	}
-	if conf.UploadMaxSpeed == 0 {
-		conf.UploadMaxSpeed = 2 * 1024 * 1024
-	}
 	if conf.ClientString == "" {
 		conf.ClientString = "++" // verified
 	}
@@ -234,53 +379,26 @@ func NewClient(conf ClientConf) (*Client, error) {
 		conf.ListGenerator = "DC++ 0.868" // verified
 	}
 
-	u, err := url.Parse(conf.HubURL)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse hub url")
-	}
-	if _, ok := map[string]struct{}{
-		"adc":   {},
-		"adcs":  {},
-		"dchub": {},
-		"nmdc":  {},
-		"nmdcs": {},
-	}[u.Scheme]; !ok {
-		return nil, fmt.Errorf("unsupported protocol: %s", u.Scheme)
-	}
-	if u.Port() == "" {
-		switch u.Scheme {
-		case "adc":
-			u.Host = u.Hostname() + ":5000"
-
-		case "adcs":
-			u.Host = u.Hostname() + ":5001"
-
-		default:
-			u.Host = u.Hostname() + ":411"
-		}
-	}
-	conf.HubURL = u.String()
-
 	c := &Client{
 		conf:                  conf,
 		privateID:             conf.PID,
 		terminate:             make(chan struct{}),
-		proto:                 protocolNMDC,
-		hubIsEncrypted:        u.Scheme == "adcs" || u.Scheme == "nmdcs",
-		hubHostname:           u.Hostname(),
-		hubPort:               atoui(u.Port()),
-		shareRoots:            make(map[string]string),
+		shareRoots:            make(map[string]*shareRoot),
 		shareTree:             make(map[string]*shareDirectory),
-		peers:                 make(map[string]*Peer),
+		shareByTTH:            make(map[tiger.Hash][]*shareFile),
 		downloadSlotAvail:     conf.DownloadMaxParallel,
 		uploadSlotAvail:       conf.UploadMaxParallel,
+		uploadMiniSlotAvail:   conf.UploadMiniSlots,
+		uploadLimiter:         newRateLimiter(uint64(conf.UploadMaxSpeed)),
+		downloadLimiter:       newRateLimiter(uint64(conf.DownloadMaxSpeed)),
 		peerConns:             make(map[*peerConn]struct{}),
 		peerConnsByKey:        make(map[nickDirectionPair]*peerConn),
 		transfers:             make(map[transfer]struct{}),
-		activeDownloadsByPeer: make(map[string]*Download),
-	}
-	if u.Scheme == "adc" || u.Scheme == "adcs" {
-		c.proto = protocolADC
+		activeDownloadsByPeer: make(map[hubNickPair]*Download),
+		multiSourceDownloads:  make(map[*MultiSourceDownload]struct{}),
+		searches:              make(map[*SearchHandle]struct{}),
+		searchSources:         make(map[string]*searchIncomingSource),
+		grantedSlots:          make(map[hubNickPair]time.Time),
 	}
 
 	// generate privateID if not provided (random)
@@ -294,8 +412,22 @@ func NewClient(conf ClientConf) (*Client, error) {
 	hasher.Write(c.privateID[:])
 	hasher.Sum(c.clientID[:0])
 
-	if err := newHubConn(c); err != nil {
-		return nil, err
+	if conf.HubURL != "" {
+		if _, err := c.HubAdd(conf.HubURL, conf.Nick, conf.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.QueueFile != "" {
+		if err := c.queueLoad(); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.FavoritesFile != "" {
+		if err := c.favoritesLoad(); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := newshareIndexer(c); err != nil {
@@ -323,18 +455,6 @@ func NewClient(conf ClientConf) (*Client, error) {
 	return c, nil
 }
 
-func (c *Client) getProto() protocolName {
-	return protocolName(atomic.LoadUint32((*uint32)(&c.proto)))
-}
-
-func (c *Client) setProto(p protocolName) {
-	atomic.StoreUint32((*uint32)(&c.proto), uint32(p))
-}
-
-func (c *Client) protoIsAdc() bool {
-	return c.getProto() == protocolADC
-}
-
 // Close every open connection and stop the client.
 func (c *Client) Close() error {
 	if c.terminateRequested {
@@ -359,6 +479,11 @@ func (c *Client) Run() {
 	c.wg.Add(1)
 	go c.shareIndexer.do()
 
+	if c.shareIndexer.watcher != nil {
+		c.wg.Add(1)
+		go c.shareIndexer.watcher.do()
+	}
+
 	if c.listenerTCP != nil {
 		c.wg.Add(1)
 		go c.listenerTCP.do()
@@ -377,6 +502,7 @@ func (c *Client) Run() {
 	}
 
 	c.Safe(func() {
+		c.started = true
 		if !c.conf.HubManualConnect {
 			c.HubConnect()
 		}
@@ -385,7 +511,15 @@ func (c *Client) Run() {
 	<-c.terminate
 
 	c.Safe(func() {
-		c.hubConn.close()
+		for _, h := range c.hubs {
+			h.close()
+		}
+		for d := range c.multiSourceDownloads {
+			d.Close()
+		}
+		for sh := range c.searches {
+			sh.Close()
+		}
 		for t := range c.transfers {
 			t.Close()
 		}
@@ -428,18 +562,24 @@ func (c *Client) getPublicIP() error {
 	return nil
 }
 
-func (c *Client) sendInfos(firstTime bool) {
+func (h *Hub) sendInfos(firstTime bool) {
 	hubUnregisteredCount := uint(0)
 	hubRegisteredCount := uint(0)
 	hubOperatorCount := uint(0)
 
-	if c.hubConn.passwordSent {
-		hubRegisteredCount = 1
-	} else {
-		hubUnregisteredCount = 1
+	c := h.client
+	for _, oh := range c.hubs {
+		if oh != h && oh.state != hubInitialized {
+			continue
+		}
+		if oh.passwordSent {
+			hubRegisteredCount++
+		} else {
+			hubUnregisteredCount++
+		}
 	}
 
-	if c.protoIsAdc() {
+	if h.protoIsAdc() {
 		info := &adc.UserInfo{
 			Desc:           c.conf.Description,
 			ShareFiles:     int(c.shareCount),
@@ -449,7 +589,7 @@ func (c *Client) sendInfos(firstTime bool) {
 			HubsOperator:   int(hubOperatorCount),
 			Application:    c.conf.ClientString,  // verified
 			Version:        c.conf.ClientVersion, // verified
-			MaxUpload:      numtoa(c.conf.UploadMaxSpeed),
+			MaxUpload:      numtoa(c.advertisedUploadSpeed()),
 			Slots:          int(c.conf.UploadMaxParallel),
 		}
 
@@ -468,7 +608,7 @@ func (c *Client) sendInfos(firstTime bool) {
 
 		// these must be sent only during initialization
 		if firstTime {
-			info.Name = c.conf.Nick
+			info.Name = h.nick
 			info.Id = c.clientID
 			info.Pid = &c.privateID
 
@@ -478,8 +618,8 @@ func (c *Client) sendInfos(firstTime bool) {
 			}
 		}
 
-		c.hubConn.conn.Write(&protoadc.AdcBInfos{ //nolint:govet
-			&adc.BroadcastPacket{ID: c.adcSessionID},
+		h.conn.Write(&protoadc.AdcBInfos{ //nolint:govet
+			&adc.BroadcastPacket{ID: h.adcSessionID},
 			info,
 		})
 	} else {
@@ -492,8 +632,8 @@ func (c *Client) sendInfos(firstTime bool) {
 			userFlag |= nmdc.FlagTLSDownload | nmdc.FlagTLSUpload
 		}
 
-		c.hubConn.conn.Write(&nmdc.MyINFO{
-			Name: c.conf.Nick,
+		h.conn.Write(&nmdc.MyINFO{
+			Name: h.nick,
 			Desc: c.conf.Description,
 			Client: types.Software{
 				Name:    c.conf.ClientString,
@@ -509,7 +649,7 @@ func (c *Client) sendInfos(firstTime bool) {
 			HubsRegistered: int(hubRegisteredCount),
 			HubsOperator:   int(hubOperatorCount),
 			Slots:          int(c.conf.UploadMaxParallel),
-			Conn:           fmt.Sprintf("%d KiB/s", c.conf.UploadMaxSpeed/1024),
+			Conn:           fmt.Sprintf("%d KiB/s", c.advertisedUploadSpeed()/1024),
 			Flag:           userFlag,
 			Email:          c.conf.Email,
 			ShareSize:      c.shareSize,
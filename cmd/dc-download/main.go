@@ -49,7 +49,7 @@ func main() {
 		}
 	}
 
-	client.OnShareIndexed = func() {
+	client.OnShareIndexed = func(dctk.ShareIndexSummary) {
 		client.HubConnect()
 	}
 
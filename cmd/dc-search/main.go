@@ -47,11 +47,11 @@ func main() {
 		}
 	}
 
-	client.OnShareIndexed = func() {
+	client.OnShareIndexed = func(dctk.ShareIndexSummary) {
 		client.HubConnect()
 	}
 
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		client.Search(dctk.SearchConf{
 			Query: *query,
 		})
@@ -41,7 +41,7 @@ func main() {
 		client.ShareAdd(*alias, *share)
 	}
 
-	client.OnShareIndexed = func() {
+	client.OnShareIndexed = func(dctk.ShareIndexSummary) {
 		client.HubConnect()
 	}
 
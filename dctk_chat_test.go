@@ -41,7 +41,7 @@ func TestChatPrivate(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -102,7 +102,7 @@ func TestChatPublic(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -1,12 +1,16 @@
 package dctk
 
 import (
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/aler9/go-dc/nmdc"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protocommon"
 )
 
 func TestConnActive(t *testing.T) {
@@ -24,7 +28,7 @@ func TestConnActive(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		client.OnHubConnected = func() {
+		client.OnHubConnected = func(h *Hub) {
 			go func() {
 				time.Sleep(1 * time.Second)
 				client.Safe(func() {
@@ -51,7 +55,7 @@ func TestConnCompression(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		client.OnHubConnected = func() {
+		client.OnHubConnected = func(h *Hub) {
 			go func() {
 				time.Sleep(1 * time.Second)
 				client.Safe(func() {
@@ -81,7 +85,7 @@ func TestConnNoIP(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		client.OnHubConnected = func() {
+		client.OnHubConnected = func(h *Hub) {
 			go func() {
 				time.Sleep(1 * time.Second)
 				client.Safe(func() {
@@ -108,7 +112,7 @@ func TestConnPassive(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		client.OnHubConnected = func() {
+		client.OnHubConnected = func(h *Hub) {
 			go func() {
 				time.Sleep(1 * time.Second)
 				client.Safe(func() {
@@ -139,7 +143,7 @@ func TestConnPwd(t *testing.T) {
 		})
 		require.NoError(t, err)
 
-		client.OnHubConnected = func() {
+		client.OnHubConnected = func(h *Hub) {
 			go func() {
 				time.Sleep(1 * time.Second)
 				client.Safe(func() {
@@ -153,3 +157,242 @@ func TestConnPwd(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestConnReconnectDelay(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:             log.LevelError,
+		Nick:                 "testdctk",
+		IsPassive:            true,
+		HubReconnectMinDelay: 1 * time.Second,
+		HubReconnectMaxDelay: 10 * time.Second,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd("adc://127.0.0.1:1", "", "")
+	require.NoError(t, err)
+
+	// the delay is doubled after every attempt, up to the max delay
+	for attempt, exp := range []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	} {
+		h.reconnectAttempt = uint(attempt + 1)
+		require.Equal(t, exp, h.reconnectDelay())
+	}
+
+	// jitter stays within bounds
+	client.conf.HubReconnectJitter = 0.2
+	h.reconnectAttempt = 3
+	for i := 0; i < 100; i++ {
+		delay := h.reconnectDelay()
+		require.GreaterOrEqual(t, delay, 3200*time.Millisecond)
+		require.LessOrEqual(t, delay, 4800*time.Millisecond)
+	}
+}
+
+func TestConnReconnectMaxTries(t *testing.T) {
+	// get a port on which nothing is listening
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	client, err := NewClient(ClientConf{
+		LogLevel:             log.LevelError,
+		Nick:                 "testdctk",
+		IsPassive:            true,
+		HubManualConnect:     true,
+		HubConnTries:         1,
+		HubReconnect:         true,
+		HubReconnectMaxTries: 2,
+		HubReconnectMinDelay: 10 * time.Millisecond,
+		HubReconnectMaxDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd(fmt.Sprintf("adc://127.0.0.1:%d", port), "", "")
+	require.NoError(t, err)
+
+	var attempts []uint
+	client.OnHubReconnecting = func(h *Hub, attempt uint, delay time.Duration) {
+		attempts = append(attempts, attempt)
+	}
+
+	client.Safe(func() {
+		h.Connect()
+	})
+
+	// the hub is removed after the last attempt, and the client is closed
+	// since there are no hubs left
+	select {
+	case <-client.terminate:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub not removed")
+	}
+	client.wg.Wait()
+
+	client.Safe(func() {
+		require.Equal(t, []uint{1, 2}, attempts)
+		require.Equal(t, 0, len(client.Hubs()))
+	})
+}
+
+func TestConnMultiHub(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		HubManualConnect: true,
+	})
+	require.NoError(t, err)
+
+	h1, err := client.HubAdd("nmdc://127.0.0.1:1", "", "")
+	require.NoError(t, err)
+	h1.conn = &testConn{}
+	h2, err := client.HubAdd("nmdc://127.0.0.1:2", "othernick", "")
+	require.NoError(t, err)
+	h2.conn = &testConn{}
+	require.Equal(t, []*Hub{h1, h2}, client.Hubs())
+	require.Equal(t, "testdctk", h1.Nick())
+	require.Equal(t, "othernick", h2.Nick())
+
+	// the same nick is in use in both hubs
+	p1 := &Peer{Hub: h1, Nick: "shared"}
+	p2 := &Peer{Hub: h2, Nick: "shared"}
+	p3 := &Peer{Hub: h2, Nick: "only2"}
+	client.handlePeerConnected(p1)
+	client.handlePeerConnected(p2)
+	client.handlePeerConnected(p3)
+
+	require.Equal(t, map[string]*Peer{"shared": p1}, h1.Peers())
+	require.Equal(t, map[string]*Peer{"shared": p2, "only2": p3}, h2.Peers())
+	require.Equal(t, 2, len(client.Peers()))
+
+	handshake := func(pconn *peerConn, nick string, remoteIsUpload bool) error {
+		for _, msg := range []protocommon.MsgDecodable{
+			&nmdc.MyNick{Name: nmdc.Name(nick)},
+			&nmdc.Lock{Lock: "EXTENDEDPROTOCOLABCABCABCABCABCABC", PK: "test"},
+			&nmdc.Supports{},
+			&nmdc.Direction{Upload: remoteIsUpload, Number: 0},
+			&nmdc.Key{},
+		} {
+			if err := pconn.handleMessage(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	newPeerConn := func(h *Hub) *peerConn {
+		return &peerConn{
+			client:  client,
+			hub:     h,
+			proto:   protocolNMDC,
+			conn:    &testConn{},
+			state:   "connected",
+			limiter: newRateLimiter(0),
+		}
+	}
+
+	// without pending downloads, the peer of the first hub is picked
+	require.Equal(t, p1, client.peerByNick(protocolNMDC, "shared"))
+	pconn1 := newPeerConn(nil)
+	require.NoError(t, handshake(pconn1, "shared", false))
+	require.Equal(t, p1, pconn1.peer)
+	require.Equal(t, h1, pconn1.hub)
+	require.Equal(t, pconn1, client.peerConnsByKey[nickDirectionPair{h1, "shared", "upload"}])
+
+	// the peer with a pending download is preferred
+	dl := &Download{
+		conf:     DownloadConf{Peer: p2},
+		state:    "waiting_peer",
+		peerChan: make(chan struct{}, 1),
+	}
+	client.activeDownloadsByPeer[hubNickPair{h2, "shared"}] = dl
+	require.Equal(t, p2, client.peerByNick(protocolNMDC, "shared"))
+	pconn2 := newPeerConn(nil)
+	require.NoError(t, handshake(pconn2, "shared", true))
+	require.Equal(t, p2, pconn2.peer)
+	require.Equal(t, h2, pconn2.hub)
+	require.Equal(t, pconn2, dl.pconn)
+	require.Equal(t, pconn2, client.peerConnsByKey[nickDirectionPair{h2, "shared", "download"}])
+
+	// connections with the same nick and direction in different hubs do not collide
+	pconn3 := newPeerConn(h2)
+	require.NoError(t, handshake(pconn3, "shared", false))
+	require.Equal(t, p2, pconn3.peer)
+	require.Equal(t, pconn3, client.peerConnsByKey[nickDirectionPair{h2, "shared", "upload"}])
+	require.Equal(t, pconn1, client.peerConnsByKey[nickDirectionPair{h1, "shared", "upload"}])
+
+	// a second connection in the same hub is refused
+	require.Error(t, handshake(newPeerConn(h1), "shared", false))
+
+	// peers of a removed hub are not returned anymore
+	client.HubDel(h1)
+	require.Equal(t, []*Hub{h2}, client.Hubs())
+	require.Equal(t, p2, client.peerByNick(protocolNMDC, "shared"))
+}
+
+func TestConnRedirect(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		HubManualConnect: true,
+		FollowRedirects:  true,
+		RedirectLimit:    2,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd("nmdcs://hub1.example.com:411", "", "")
+	require.NoError(t, err)
+
+	// addresses without a protocol use the one of the current hub
+	require.True(t, h.handleRedirect("hub2.example.com:412"))
+	require.Equal(t, "nmdcs://hub2.example.com:412", h.URL())
+	require.Equal(t, "hub2.example.com", h.hostname)
+	require.Equal(t, uint(412), h.port)
+	require.True(t, h.isEncrypted)
+	require.False(t, h.protoIsAdc())
+
+	// the protocol can be changed
+	require.True(t, h.handleRedirect("adc://hub3.example.com:413"))
+	require.Equal(t, "adc://hub3.example.com:413", h.URL())
+	require.True(t, h.protoIsAdc())
+
+	// the limit is enforced
+	require.False(t, h.handleRedirect("adc://hub4.example.com:414"))
+	require.Equal(t, "adc://hub3.example.com:413", h.URL())
+
+	// short sessions do not reset the count
+	h.handleHubInitialized()
+	require.False(t, h.handleRedirect("adc://hub4.example.com:414"))
+
+	// long sessions do
+	h.initializedAt = time.Now().Add(-hubRedirectResetPeriod)
+	require.True(t, h.handleRedirect("adc://hub4.example.com:414"))
+	require.Equal(t, "adc://hub4.example.com:414", h.URL())
+
+	// redirects can be refused
+	h.redirectCount = 0
+	var redirects []string
+	client.OnHubRedirect = func(h *Hub, url string) bool {
+		redirects = append(redirects, url)
+		return false
+	}
+	require.False(t, h.handleRedirect("nmdc://hub5.example.com:415"))
+	require.Equal(t, []string{"nmdc://hub5.example.com:415"}, redirects)
+	require.Equal(t, "adc://hub4.example.com:414", h.URL())
+
+	// invalid addresses are refused
+	client.OnHubRedirect = nil
+	require.False(t, h.handleRedirect("http://hub6.example.com"))
+
+	// redirects are not followed when disabled
+	client.conf.FollowRedirects = false
+	require.False(t, h.handleRedirect("adc://hub7.example.com:417"))
+}
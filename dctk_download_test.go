@@ -1,9 +1,11 @@
 package dctk
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -36,7 +38,7 @@ func TestDownloadActive(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -55,7 +57,7 @@ func TestDownloadActive(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -113,7 +115,7 @@ func TestDownloadDir(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -132,7 +134,7 @@ func TestDownloadDir(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -236,7 +238,7 @@ func TestDownloadError(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -290,7 +292,7 @@ func TestDownloadFromList(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -309,7 +311,7 @@ func TestDownloadFromList(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -371,7 +373,7 @@ func TestDownloadOnDisk(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -390,7 +392,7 @@ func TestDownloadOnDisk(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -443,7 +445,7 @@ func TestDownloadPassive(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -461,7 +463,7 @@ func TestDownloadPassive(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -514,7 +516,7 @@ func TestDownloadTls(t *testing.T) {
 				client.ShareAdd("share", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -534,7 +536,7 @@ func TestDownloadTls(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -560,3 +562,424 @@ func TestDownloadTls(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestDownloadMultiSource(t *testing.T) {
+	foreachExternalHub(t, "DownloadMultiSource", func(t *testing.T, e *externalHub) {
+		ok := false
+
+		content := make([]byte, 3*1024*1024+100)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+
+		client1 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client1",
+				IP:                 dockerIP,
+				TCPPort:            3006,
+				UDPPort:            3006,
+				PeerEncryptionMode: DisableEncryption,
+				HubManualConnect:   true,
+			})
+			require.NoError(t, err)
+
+			os.RemoveAll("/tmp/testshare")
+			os.Mkdir("/tmp/testshare", 0o755)
+			os.WriteFile("/tmp/testshare/test file.bin", content, 0o644)
+
+			client.OnInitialized = func() {
+				client.ShareAdd("share", "/tmp/testshare")
+			}
+
+			client.OnShareIndexed = func(ShareIndexSummary) {
+				client.HubConnect()
+			}
+
+			client.Run()
+		}
+
+		client2 := func() {
+			client, err := NewClient(ClientConf{
+				LogLevel:           log.LevelError,
+				HubURL:             e.URL(),
+				Nick:               "client2",
+				IP:                 dockerIP,
+				TCPPort:            3005,
+				UDPPort:            3005,
+				PeerEncryptionMode: DisableEncryption,
+			})
+			require.NoError(t, err)
+
+			os.Remove("/tmp/testdownload.bin")
+
+			client.OnHubConnected = func(h *Hub) {
+				go client1()
+			}
+
+			client.OnPeerConnected = func(p *Peer) {
+				if p.Nick == "client1" {
+					_, err := client.MultiSourceDownload(MultiSourceDownloadConf{
+						Peers:       []*Peer{p},
+						TTH:         tiger.HashFromBytes(content),
+						Size:        uint64(len(content)),
+						SavePath:    "/tmp/testdownload.bin",
+						SegmentSize: 512 * 1024,
+					})
+					require.NoError(t, err)
+				}
+			}
+
+			client.OnMultiSourceDownloadSuccessful = func(d *MultiSourceDownload) {
+				ok = true
+				client.Close()
+			}
+
+			client.OnMultiSourceDownloadError = func(d *MultiSourceDownload, err error) {
+				t.Errorf("download error: %s", err)
+				client.Close()
+			}
+
+			client.Run()
+		}
+
+		client2()
+
+		require.True(t, ok)
+		buf, err := os.ReadFile("/tmp/testdownload.bin")
+		require.NoError(t, err)
+		require.Equal(t, content, buf)
+	})
+}
+
+func TestDownloadResumeOffset(t *testing.T) {
+	content := make([]byte, 10*4096+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	var leaves tiger.Leaves
+	for i := 0; i < len(content); i += 4096 {
+		end := i + 4096
+		if end > len(content) {
+			end = len(content)
+		}
+		leaves = append(leaves, tiger.HashFromBytes(content[i:end]))
+	}
+
+	fpath := "/tmp/testresume.tmp"
+	defer os.Remove(fpath)
+
+	// partial file
+	os.WriteFile(fpath, content[:5*4096+300], 0o644)
+	offset, err := downloadResumeOffset(fpath, leaves)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5*4096), offset)
+
+	// partial file with a corrupted block
+	corrupted := append([]byte(nil), content[:7*4096]...)
+	corrupted[3*4096+10]++
+	os.WriteFile(fpath, corrupted, 0o644)
+	offset, err = downloadResumeOffset(fpath, leaves)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3*4096), offset)
+
+	// unrelated file
+	os.WriteFile(fpath, []byte(strings.Repeat("A", 20000)), 0o644)
+	offset, err = downloadResumeOffset(fpath, leaves)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func TestDownloadQueuePersistence(t *testing.T) {
+	os.Remove("/tmp/testqueue.json")
+	defer os.Remove("/tmp/testqueue.json")
+
+	client, err := NewClient(ClientConf{
+		LogLevel:  log.LevelError,
+		Nick:      "client1",
+		IsPassive: true,
+		QueueFile: "/tmp/testqueue.json",
+	})
+	require.NoError(t, err)
+
+	tth := tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY")
+	item := client.QueueAdd(tth, "/tmp/test file.txt", 10000, DownloadPriorityHigh)
+	item.Sources = append(item.Sources, &QueueSource{HubURL: "adc://localhost:5000", Nick: "client2"})
+	item.SetPriority(DownloadPriorityLow)
+
+	client, err = NewClient(ClientConf{
+		LogLevel:  log.LevelError,
+		Nick:      "client1",
+		IsPassive: true,
+		QueueFile: "/tmp/testqueue.json",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(client.Queue()))
+	item = client.Queue()[0]
+	require.Equal(t, tth, item.TTH)
+	require.Equal(t, "/tmp/test file.txt", item.SavePath)
+	require.Equal(t, uint64(10000), item.Size)
+	require.Equal(t, DownloadPriorityLow, item.Priority)
+	require.Equal(t, []*QueueSource{{HubURL: "adc://localhost:5000", Nick: "client2"}}, item.Sources)
+}
+
+func TestDownloadHubRemoved(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:            log.LevelError,
+		Nick:                "client1",
+		IsPassive:           true,
+		HubManualConnect:    true,
+		DownloadMaxParallel: 1,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd("adc://localhost:5000", "", "")
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	client.Safe(func() {
+		_, err = client.DownloadFile(DownloadConf{
+			Peer: &Peer{Hub: h, Nick: "peer1"},
+			TTH:  tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+			onExit: func(d *Download, err error) {
+				done <- err
+			},
+		})
+	})
+	require.NoError(t, err)
+
+	// the download waits for the hub without taking a slot
+	require.Eventually(t, func() bool {
+		ok := false
+		client.Safe(func() {
+			for t := range client.transfers {
+				ok = t.(*Download).state == "waiting_hub"
+			}
+		})
+		return ok
+	}, 1*time.Second, 10*time.Millisecond)
+	client.Safe(func() {
+		require.Equal(t, uint(1), client.downloadSlotAvail)
+	})
+
+	// the download fails when the hub is removed
+	client.Safe(func() {
+		client.HubDel(h)
+	})
+	select {
+	case err := <-done:
+		require.EqualError(t, err, "hub was removed")
+	case <-time.After(1 * time.Second):
+		t.Fatal("download did not fail")
+	}
+	client.wg.Wait()
+}
+
+func TestDownloadQueueRetry(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		Nick:             "client1",
+		IsPassive:        true,
+		HubManualConnect: true,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd("adc://localhost:5000", "", "")
+	require.NoError(t, err)
+	peer1 := &Peer{Hub: h, Nick: "peer1"}
+	peer2 := &Peer{Hub: h, Nick: "peer2"}
+
+	tth := tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY")
+	item := client.QueueAdd(tth, "/tmp/test file.txt", 10000, DownloadPriorityNormal)
+	item.AddSource(peer1)
+	item.AddSource(peer2)
+	src1 := item.Sources[0]
+
+	var errs []error
+	client.OnQueueItemError = func(item *QueueItem, p *Peer, err error) {
+		errs = append(errs, err)
+	}
+
+	fail := func(src *QueueSource, p *Peer, err error) {
+		d := &Download{conf: DownloadConf{Peer: p}}
+		item.dl = d
+		client.handleQueueDownloadExit(item, src, d, err)
+	}
+
+	// temporary errors delay the source, with exponential backoff
+	fail(src1, peer1, fmt.Errorf("maxed out"))
+	require.Equal(t, 2, len(item.Sources))
+	require.Nil(t, item.dl)
+	delay := time.Until(src1.retryAt)
+	require.Greater(t, delay, queueSourceRetryMinDelay-time.Second)
+	require.LessOrEqual(t, delay, queueSourceRetryMinDelay)
+
+	for i := 0; i < 10; i++ {
+		fail(src1, peer1, fmt.Errorf("maxed out"))
+	}
+	require.Equal(t, 2, len(item.Sources))
+	require.LessOrEqual(t, time.Until(src1.retryAt), queueSourceRetryMaxDelay)
+	require.Greater(t, time.Until(src1.retryAt), queueSourceRetryMaxDelay-time.Second)
+
+	// the source can be used again when the peer reconnects
+	client.handlePeerConnected(peer1)
+	require.Equal(t, uint(0), src1.failures)
+	require.True(t, src1.retryAt.IsZero())
+
+	// permanent errors remove the source
+	fail(item.Sources[1], peer2, errorFileNotAvailable)
+	require.Equal(t, []*QueueSource{src1}, item.Sources)
+	fail(src1, peer1, errorValidationFailed)
+	require.Equal(t, 0, len(item.Sources))
+	require.Equal(t, 1, len(client.Queue()))
+	require.Equal(t, 13, len(errs))
+}
+
+func TestDownloadQueueBusySources(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		Nick:             "client1",
+		IsPassive:        true,
+		HubManualConnect: true,
+	})
+	require.NoError(t, err)
+
+	h, err := client.HubAdd("adc://localhost:5000", "", "")
+	require.NoError(t, err)
+	peer1 := &Peer{Hub: h, Nick: "peer1"}
+	peer2 := &Peer{Hub: h, Nick: "peer2"}
+	client.handlePeerConnected(peer1)
+	client.handlePeerConnected(peer2)
+
+	// both items are shared by both peers
+	item1 := client.QueueAdd(tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+		"/tmp/test file1.txt", 10000, DownloadPriorityNormal)
+	item2 := client.QueueAdd(tiger.HashMust("UAUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+		"/tmp/test file2.txt", 10000, DownloadPriorityNormal)
+	for _, item := range []*QueueItem{item1, item2} {
+		item.AddSource(peer1)
+		item.AddSource(peer2)
+	}
+
+	client.Safe(func() {
+		h.state = hubInitialized
+		client.queueSchedule()
+
+		// each item is downloaded from a different peer
+		require.NotNil(t, item1.dl)
+		require.NotNil(t, item2.dl)
+		require.Equal(t, peer1, item1.dl.conf.Peer)
+		require.Equal(t, peer2, item2.dl.conf.Peer)
+
+		// let the downloads stop while waiting for the hub
+		h.state = hubConnected
+		item1.dl.Close()
+		item2.dl.Close()
+	})
+}
+
+func TestTransferMaxSpeed(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		IsPassive:        true,
+		HubManualConnect: true,
+		Nick:             "client",
+		DownloadMaxSpeed: 100 * 1024,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint(uploadAdvertisedSpeed), client.advertisedUploadSpeed())
+
+	start := time.Now()
+	client.downloadLimiter.wait(50 * 1024)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// limits can be changed at runtime
+	client.SetDownloadMaxSpeed(0)
+	start = time.Now()
+	client.downloadLimiter.wait(100 * 1024 * 1024)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	client.SetUploadMaxSpeed(1024 * 1024)
+	require.Equal(t, uint(1024*1024), client.advertisedUploadSpeed())
+	start = time.Now()
+	client.uploadLimiter.wait(200 * 1024)
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, 150*time.Millisecond)
+	require.Less(t, elapsed, 1*time.Second)
+}
+
+func TestDownloadMultiSourceSegmentSize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-multisource")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		IsPassive:        true,
+		HubManualConnect: true,
+		Nick:             "client",
+	})
+	require.NoError(t, err)
+
+	content := []byte("0123456789")
+	tth := tiger.HashFromBytes(content)
+
+	newDownload := func(savePath string) (*MultiSourceDownload, *multiSourceSource, *multiSourceSegment) {
+		f, err := os.Create(savePath + ".tmp")
+		require.NoError(t, err)
+
+		src := &multiSourceSource{peer: &Peer{Hub: &Hub{client: client}, Nick: "peer"}}
+		seg := &multiSourceSegment{start: 0, length: uint64(len(content))}
+		d := &MultiSourceDownload{
+			conf:      MultiSourceDownloadConf{TTH: tth, Size: uint64(len(content)), SavePath: savePath},
+			client:    client,
+			terminate: make(chan struct{}),
+			file:      f,
+			sources:   []*multiSourceSource{src},
+			segments:  []*multiSourceSegment{seg},
+			leaves:    tiger.Leaves{tth},
+			blockSize: uint64(len(content)),
+		}
+		src.seg = seg
+		seg.dl = &Download{}
+		return d, src, seg
+	}
+
+	var errs []error
+	client.OnMultiSourceDownloadError = func(d *MultiSourceDownload, err error) {
+		errs = append(errs, err)
+	}
+
+	// a segment with a wrong size is a failure of the source, and the download
+	// waits for the source to come online again
+	d, src, seg := newDownload(dir + "/short")
+	client.Safe(func() {
+		d.handleSegmentExit(src, seg, &Download{content: content[:5]}, nil)
+	})
+	require.Equal(t, uint(1), src.failures)
+	require.False(t, seg.done)
+	require.Nil(t, seg.dl)
+	require.Equal(t, []error(nil), errs)
+	client.Safe(d.Close)
+
+	// a segment with the right size is verified and saved
+	completed := make(chan struct{})
+	client.OnMultiSourceDownloadSuccessful = func(d *MultiSourceDownload) {
+		close(completed)
+	}
+	d, src, seg = newDownload(dir + "/ok")
+	client.Safe(func() {
+		d.handleSegmentExit(src, seg, &Download{content: content}, nil)
+	})
+	<-completed
+	client.Safe(func() {
+		require.Equal(t, uint(0), src.failures)
+		require.True(t, seg.done)
+	})
+	saved, err := os.ReadFile(dir + "/ok")
+	require.NoError(t, err)
+	require.Equal(t, content, saved)
+}
@@ -1,14 +1,20 @@
 package dctk
 
 import (
+	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aler9/go-dc/adc"
+	"github.com/aler9/go-dc/nmdc"
+	godctiger "github.com/aler9/go-dc/tiger"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protoadc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
@@ -38,7 +44,7 @@ func TestSearchActive(t *testing.T) {
 				client.ShareAdd("aliasname", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -61,7 +67,7 @@ func TestSearchActive(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -92,9 +98,10 @@ func TestSearchActive(t *testing.T) {
 						t.Errorf("wrong result (1): %+v", res)
 					}
 					step++
-					require.NoError(t, client.Search(SearchConf{
+					_, err := client.Search(SearchConf{
 						Query: "test file",
-					}))
+					})
+					require.NoError(t, err)
 
 				case 1:
 					if res.IsDir != false ||
@@ -158,7 +165,7 @@ func TestSearchPassive(t *testing.T) {
 				client.ShareAdd("aliasname", "/tmp/testshare")
 			}
 
-			client.OnShareIndexed = func() {
+			client.OnShareIndexed = func(ShareIndexSummary) {
 				client.HubConnect()
 			}
 
@@ -176,7 +183,7 @@ func TestSearchPassive(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			client.OnHubConnected = func() {
+			client.OnHubConnected = func(h *Hub) {
 				go client1()
 			}
 
@@ -246,3 +253,428 @@ func TestSearchPassive(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func testSearchShareTree(dirCount int, filesPerDir int) map[string]*shareDirectory {
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	root := &shareDirectory{
+		dirs:      make(map[string]*shareDirectory),
+		files:     make(map[string]*shareFile),
+		aliasPath: "/share",
+	}
+	for i := 0; i < dirCount; i++ {
+		dname := fmt.Sprintf("%s folder %d", words[i%len(words)], i)
+		dir := &shareDirectory{
+			dirs:      make(map[string]*shareDirectory),
+			files:     make(map[string]*shareFile),
+			aliasPath: "/share/" + dname,
+		}
+		for j := 0; j < filesPerDir; j++ {
+			fname := fmt.Sprintf("%s %s track %d.mp3", words[j%len(words)], words[(i+j)%len(words)], j)
+			dir.files[fname] = &shareFile{
+				size:      uint64(j),
+				aliasPath: dir.aliasPath + "/" + fname,
+			}
+		}
+		root.dirs[dname] = dir
+	}
+	return map[string]*shareDirectory{"share": root}
+}
+
+func TestSearchIncomingByName(t *testing.T) {
+	c := &Client{
+		shareIndex: newShareNameIndex(testSearchShareTree(20, 20)),
+	}
+
+	for _, ca := range []struct {
+		name  string
+		req   *searchIncomingRequest
+		paths []string
+	}{
+		{
+			"directory",
+			&searchIncomingRequest{isActive: true, stype: SearchDirectory, terms: []string{"Bravo", "folder 17"}},
+			[]string{"/share/bravo folder 17"},
+		},
+		{
+			"file in directory",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 3", "charlie", "track 2."}},
+			[]string{"/share/delta folder 3/charlie foxtrot track 2.mp3"},
+		},
+		{
+			"short terms",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 4", "k", "10"}},
+			[]string{"/share/echo folder 4/charlie golf track 10.mp3"},
+		},
+		{
+			"only short terms",
+			&searchIncomingRequest{isActive: true, terms: []string{"16", "O"}, fileOnly: true, exactSize: 3},
+			[]string{"/share/alpha folder 16/delta delta track 3.mp3"},
+		},
+		{
+			"size",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 5", "track 1"}, minSize: 15},
+			[]string{
+				"/share/foxtrot folder 5/alpha foxtrot track 16.mp3",
+				"/share/foxtrot folder 5/bravo golf track 17.mp3",
+				"/share/foxtrot folder 5/charlie hotel track 18.mp3",
+				"/share/foxtrot folder 5/delta alpha track 19.mp3",
+				"/share/foxtrot folder 5/hotel echo track 15.mp3",
+			},
+		},
+		{
+			"excluded terms",
+			&searchIncomingRequest{
+				isActive: true,
+				terms:    []string{"folder 7", "track 1"},
+				notTerms: []string{"Alpha", "bravo", "charlie", "delta", "echo", "foxtrot"},
+			},
+			[]string{"/share/hotel folder 7/hotel golf track 15.mp3"},
+		},
+		{
+			"group and exact size",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 8"}, group: adc.ExtAudio, exactSize: 4},
+			[]string{"/share/alpha folder 8/echo echo track 4.mp3"},
+		},
+		{
+			"extensions",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 8"}, exts: []string{"txt"}},
+			nil,
+		},
+		{
+			"file only",
+			&searchIncomingRequest{isActive: true, terms: []string{"alpha folder 16"}, fileOnly: true, maxSize: 1},
+			[]string{
+				"/share/alpha folder 16/alpha alpha track 0.mp3",
+				"/share/alpha folder 16/bravo bravo track 1.mp3",
+			},
+		},
+		{
+			"no results",
+			&searchIncomingRequest{isActive: true, terms: []string{"folder 5", "missing"}},
+			nil,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			results, err := c.handleSearchIncomingRequest(ca.req)
+			require.NoError(t, err)
+
+			var paths []string
+			for _, res := range results {
+				switch o := res.(type) {
+				case *shareFile:
+					paths = append(paths, o.aliasPath)
+				case *shareDirectory:
+					paths = append(paths, o.aliasPath)
+				}
+			}
+			sort.Strings(paths)
+			require.Equal(t, ca.paths, paths)
+		})
+	}
+
+	_, err := c.handleSearchIncomingRequest(&searchIncomingRequest{terms: []string{""}})
+	require.EqualError(t, err, "query is empty")
+}
+
+// BenchmarkSearchIncomingByName searches a synthetic share of one million files.
+func BenchmarkSearchIncomingByName(b *testing.B) {
+	c := &Client{
+		shareIndex: newShareNameIndex(testSearchShareTree(1000, 1000)),
+	}
+	req := &searchIncomingRequest{isActive: true, terms: []string{"folder 123", "echo", "track 9"}}
+	c.conf.LogLevel = log.LevelError
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.handleSearchIncomingRequest(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSearchOutgoingRequest(t *testing.T) {
+	conf := SearchConf{
+		Query:         "first",
+		Terms:         []string{"second"},
+		ExcludedTerms: []string{"third"},
+		FileType:      SearchFileTypeVideo,
+		Extensions:    []string{"mkv"},
+		ExactSize:     1000,
+	}
+
+	t.Run("adc", func(t *testing.T) {
+		tc := &testConn{}
+		h := &Hub{client: &Client{searches: make(map[*SearchHandle]struct{})}, conn: tc}
+		h.setProto(protocolADC)
+
+		sh, err := h.Search(conf)
+		require.NoError(t, err)
+		defer sh.Close()
+		req := tc.msgs[0].(*protoadc.AdcBSearchRequest).Msg
+		require.Equal(t, []string{"first", "second"}, req.And)
+		require.Equal(t, []string{"third"}, req.Not)
+		require.Equal(t, []string{"mkv"}, req.Ext)
+		require.Equal(t, adc.ExtVideo, req.Group)
+		require.Equal(t, int64(1000), req.Eq)
+	})
+
+	t.Run("nmdc", func(t *testing.T) {
+		tc := &testConn{}
+		h := &Hub{client: &Client{
+			conf:     ClientConf{IsPassive: true},
+			searches: make(map[*SearchHandle]struct{}),
+		}, conn: tc}
+		h.setProto(protocolNMDC)
+
+		_, err := h.Search(conf)
+		require.Error(t, err)
+
+		sh, err := h.Search(SearchConf{
+			Query:    "first",
+			Terms:    []string{"second"},
+			FileType: SearchFileTypeVideo,
+		})
+		require.NoError(t, err)
+		defer sh.Close()
+		req := tc.msgs[0].(*nmdc.Search)
+		require.Equal(t, "first second", req.Pattern)
+		require.Equal(t, nmdc.DataTypeVideo, req.DataType)
+	})
+}
+
+func TestSearchHandle(t *testing.T) {
+	c := &Client{
+		conf:     ClientConf{LogLevel: log.LevelError, IsPassive: true},
+		searches: make(map[*SearchHandle]struct{}),
+	}
+	adcHub := &Hub{client: c, conn: &testConn{}}
+	adcHub.setProto(protocolADC)
+	nmdcHub := &Hub{client: c, conn: &testConn{}}
+	nmdcHub.setProto(protocolNMDC)
+
+	var results1 []*SearchResult
+	sh1, err := c.Search(SearchConf{
+		Query: "file",
+		OnResult: func(res *SearchResult) {
+			results1 = append(results1, res)
+		},
+	})
+	require.NoError(t, err)
+
+	var results2 []*SearchResult
+	sh2, err := c.Search(SearchConf{
+		Type: SearchTTH,
+		TTH:  tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"),
+		OnResult: func(res *SearchResult) {
+			results2 = append(results2, res)
+		},
+	})
+	require.NoError(t, err)
+
+	// searches are sent to hubs manually since hubs are not initialized
+	for _, sh := range []*SearchHandle{sh1, sh2} {
+		adcHub.searchEnqueue(sh)
+		nmdcHub.searchEnqueue(sh)
+	}
+
+	tth := tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY")
+	adcPeer := &Peer{Hub: adcHub, Nick: "peer1"}
+	nmdcPeer := &Peer{Hub: nmdcHub, Nick: "peer2"}
+
+	// ADC, by token
+	c.handleSearchResult(&SearchResult{Peer: adcPeer, Path: "/a/test.txt", TTH: &tth}, sh2.tokens[adcHub])
+	c.handleSearchResult(&SearchResult{Peer: adcPeer, Path: "/b/test.txt", TTH: &tth}, sh2.tokens[adcHub])
+	c.handleSearchResult(&SearchResult{Peer: adcPeer, Path: "/a/file.txt", TTH: &tth}, "unknown")
+
+	// NMDC, by query
+	c.handleSearchResult(&SearchResult{Peer: nmdcPeer, Path: "/a/File.txt", TTH: &tth}, "")
+	c.handleSearchResult(&SearchResult{Peer: nmdcPeer, Path: "/a/other.txt"}, "")
+
+	require.Equal(t, 1, len(results1))
+	require.Equal(t, nmdcPeer, results1[0].Peer)
+	require.Equal(t, 2, len(results2))
+	require.Equal(t, adcPeer, results2[0].Peer)
+	require.Equal(t, nmdcPeer, results2[1].Peer)
+
+	// closed searches do not receive results
+	sh1.Close()
+	c.handleSearchResult(&SearchResult{Peer: nmdcPeer, Path: "/b/file.txt", TTH: &tth}, "")
+	require.Equal(t, 1, len(results1))
+	sh2.Close()
+	c.wg.Wait()
+}
+
+func TestSearchUnsupported(t *testing.T) {
+	c := &Client{
+		conf:     ClientConf{LogLevel: log.LevelError, IsPassive: true},
+		searches: make(map[*SearchHandle]struct{}),
+	}
+	adcConn := &testConn{}
+	adcHub := &Hub{client: c, conn: adcConn, state: hubInitialized}
+	adcHub.setProto(protocolADC)
+	nmdcConn := &testConn{}
+	nmdcHub := &Hub{client: c, conn: nmdcConn, state: hubInitialized}
+	nmdcHub.setProto(protocolNMDC)
+	c.hubs = []*Hub{adcHub, nmdcHub}
+
+	// a search that is not supported by a hub is not sent to any hub
+	_, err := c.Search(SearchConf{Query: "file", ExactSize: 100})
+	require.EqualError(t, err, "exact size is not supported by NMDC")
+	require.Equal(t, 0, len(adcConn.msgs))
+	require.Equal(t, 0, len(nmdcConn.msgs))
+	require.Equal(t, 0, len(c.searches))
+
+	_, err = nmdcHub.Search(SearchConf{Query: "file", ExactSize: 100})
+	require.Error(t, err)
+	require.Equal(t, 0, len(c.searches))
+
+	// the search can be sent to ADC hubs only
+	sh, err := adcHub.Search(SearchConf{Query: "file", ExactSize: 100})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(adcConn.msgs))
+	sh.Close()
+
+	sh, err = c.Search(SearchConf{Query: "file"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(adcConn.msgs))
+	require.Equal(t, 1, len(nmdcConn.msgs))
+	sh.Close()
+	c.wg.Wait()
+}
+
+func TestSearchQueue(t *testing.T) {
+	c := &Client{
+		conf: ClientConf{
+			LogLevel:          log.LevelError,
+			SearchMinInterval: 100 * time.Millisecond,
+		},
+		searches: make(map[*SearchHandle]struct{}),
+	}
+	tc := &testConn{}
+	h := &Hub{client: c, conn: tc}
+	h.setProto(protocolADC)
+
+	var sh1, sh2, sh3, sh4 *SearchHandle
+	c.Safe(func() {
+		var err error
+		sh1, err = h.Search(SearchConf{Query: "first"})
+		require.NoError(t, err)
+		sh2, err = h.Search(SearchConf{Query: "second"})
+		require.NoError(t, err)
+		sh3, err = h.Search(SearchConf{Query: "second"})
+		require.NoError(t, err)
+		sh4, err = h.Search(SearchConf{Query: "third"})
+		require.NoError(t, err)
+		sh4.Close()
+
+		// the first search is sent immediately, the others are queued
+		require.Equal(t, 1, len(tc.msgs))
+		require.Equal(t, sh2.tokens[h], sh3.tokens[h])
+		require.Equal(t, SearchStats{
+			OutgoingSent:      1,
+			OutgoingQueued:    2,
+			OutgoingCoalesced: 1,
+		}, c.SearchStats())
+	})
+
+	time.Sleep(300 * time.Millisecond)
+
+	c.Safe(func() {
+		// duplicate and closed searches are not sent
+		require.Equal(t, 2, len(tc.msgs))
+		req := tc.msgs[1].(*protoadc.AdcBSearchRequest).Msg
+		require.Equal(t, []string{"second"}, req.And)
+		require.Equal(t, sh2.tokens[h], req.Token)
+		require.Equal(t, SearchStats{
+			OutgoingSent:      2,
+			OutgoingCoalesced: 1,
+		}, c.SearchStats())
+
+		sh1.Close()
+		sh2.Close()
+		sh3.Close()
+	})
+	c.wg.Wait()
+}
+
+func TestSearchIncomingRateLimit(t *testing.T) {
+	c := &Client{
+		conf: ClientConf{
+			LogLevel:                   log.LevelError,
+			SearchIncomingMaxPerMinute: 2,
+		},
+		searchSources: make(map[string]*searchIncomingSource),
+	}
+	h := &Hub{client: c, url: "nmdc://hub", conn: &testConn{}}
+	h.setProto(protocolNMDC)
+
+	tth := godctiger.Hash(tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY"))
+	for _, user := range []string{"peer1", "peer1", "peer1", "peer2"} {
+		h.handleNmdcSearchIncomingRequest(&nmdc.Search{
+			User:     user,
+			DataType: nmdc.DataTypeTTH,
+			TTH:      &tth,
+		})
+	}
+
+	require.Equal(t, SearchStats{
+		IncomingReceived: 4,
+		IncomingDropped:  1,
+	}, c.SearchStats())
+}
+
+func TestSearchAggregator(t *testing.T) {
+	tth1 := tiger.HashMust("UJUIOGYVALWRB56PRJEB6ZH3G4OLTELOEQ3UKMY")
+	tth2 := tiger.HashMust("BR4BVJBMHDFVCFI4WBPSL63W5TWXWVBSC574BLI")
+	h := &Hub{state: hubInitialized, peers: make(map[string]*Peer)}
+	peer1 := &Peer{Hub: h, Nick: "peer1"}
+	peer2 := &Peer{Hub: h, Nick: "peer2"}
+	peer3 := &Peer{Hub: h, Nick: "peer3"}
+	peer4 := &Peer{Hub: h, Nick: "peer4"}
+	h.peers["peer1"] = peer1
+	h.peers["peer2"] = peer2
+
+	// peers are recreated when they reconnect
+	newPeer3 := &Peer{Hub: h, Nick: "peer3"}
+	h.peers["peer3"] = newPeer3
+
+	a := NewSearchAggregator()
+	a.Add(&SearchResult{Peer: peer1, Path: "/a/song.mp3", Size: 100, TTH: &tth1, SlotAvail: 1})
+	a.Add(&SearchResult{Peer: peer2, Path: "/b/Song.mp3", Size: 100, TTH: &tth1, SlotAvail: 3})
+	a.Add(&SearchResult{Peer: peer3, Path: "/c/song.mp3", Size: 100, TTH: &tth1, SlotAvail: 0})
+	a.Add(&SearchResult{Peer: peer3, Path: "/d/song.mp3", Size: 100, TTH: &tth1, SlotAvail: 0})
+	a.Add(&SearchResult{Peer: peer4, Path: "/e/song.mp3", Size: 100, TTH: &tth1, SlotAvail: 10})
+	a.Add(&SearchResult{Peer: peer1, Path: "/a/other.mp3", Size: 50, TTH: &tth2})
+	a.Add(&SearchResult{Peer: peer1, Path: "/a", IsDir: true, Size: 150})
+	a.Add(&SearchResult{Peer: peer2, Path: "/a", IsDir: true})
+
+	files := a.Files()
+	require.Equal(t, 2, len(files))
+	require.Equal(t, tth1, files[0].TTH)
+	require.Equal(t, 4, len(files[0].Results))
+	require.Equal(t, "song.mp3", files[0].Name())
+	require.Equal(t, uint(14), files[0].SlotAvail())
+
+	// peers that are gone are skipped
+	require.Equal(t, []*Peer{peer1, peer2, newPeer3}, files[0].Peers())
+	conf, err := files[0].DownloadConf("/tmp/song.mp3")
+	require.NoError(t, err)
+	require.Equal(t, DownloadConf{Peer: peer2, TTH: tth1, SavePath: "/tmp/song.mp3"}, conf)
+	require.Equal(t, MultiSourceDownloadConf{
+		Peers:    []*Peer{peer1, peer2, newPeer3},
+		TTH:      tth1,
+		Size:     100,
+		SavePath: "/tmp/song.mp3",
+	}, files[0].MultiSourceDownloadConf("/tmp/song.mp3"))
+	require.Equal(t, files[1], a.File(tth2))
+
+	delete(h.peers, "peer1")
+	_, err = files[1].DownloadConf("/tmp/other.mp3")
+	require.EqualError(t, err, "no peers are online")
+
+	dirs := a.Directories()
+	require.Equal(t, 1, len(dirs))
+	require.Equal(t, uint64(150), dirs[0].Size)
+	require.Equal(t, 2, len(dirs[0].Results))
+}
@@ -0,0 +1,56 @@
+package dctk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+func TestShareWatchMultiplePaths(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-sharewatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	realDir := filepath.Join(dir, "real")
+	linkDir := filepath.Join(dir, "link")
+	os.Mkdir(realDir, 0o755)
+	os.Symlink(realDir, linkDir)
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		ShareWatch:       true,
+	})
+	require.NoError(t, err)
+	w := client.shareIndexer.watcher
+	defer w.close()
+
+	// both paths share the same watch
+	w.sync([]string{realDir, linkDir})
+	wd := w.paths[realDir]
+	require.Equal(t, wd, w.paths[linkDir])
+	require.Equal(t, map[int32]map[string]struct{}{
+		wd: {realDir: {}, linkDir: {}},
+	}, w.watches)
+
+	// removing a path does not remove the watch of the other one
+	w.sync([]string{realDir})
+	require.Equal(t, map[string]int32{realDir: wd}, w.paths)
+	require.Equal(t, map[int32]map[string]struct{}{
+		wd: {realDir: {}},
+	}, w.watches)
+
+	// the watch is still active, therefore the same descriptor is returned
+	w.sync([]string{realDir, linkDir})
+	require.Equal(t, wd, w.paths[linkDir])
+
+	w.sync(nil)
+	require.Equal(t, 0, len(w.paths))
+	require.Equal(t, 0, len(w.watches))
+}
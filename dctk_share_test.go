@@ -2,6 +2,9 @@ package dctk
 
 import (
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
 )
 
 func TestShare(t *testing.T) {
@@ -35,7 +39,7 @@ func TestShare(t *testing.T) {
 		}
 
 		reindexed := false
-		client.OnShareIndexed = func() {
+		client.OnShareIndexed = func(ShareIndexSummary) {
 			if reindexed == false {
 				reindexed = true
 				client.HubConnect()
@@ -56,3 +60,304 @@ func TestShare(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestShareHashCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-hashcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "file.txt")
+	err = os.WriteFile(fpath, []byte(strings.Repeat("A", 50000)), 0o644)
+	require.NoError(t, err)
+	fi, err := os.Stat(fpath)
+	require.NoError(t, err)
+
+	tthl, err := tiger.LeavesFromFile(fpath)
+	require.NoError(t, err)
+
+	hc, err := newHashCache(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	require.NoError(t, hc.begin())
+	_, ok := hc.get(fpath, fi)
+	require.Equal(t, false, ok)
+	require.NoError(t, hc.set(fpath, fi, tthl))
+	require.NoError(t, hc.end())
+
+	// reload from disk
+	hc, err = newHashCache(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	require.NoError(t, hc.begin())
+	tth, ok := hc.get(fpath, fi)
+	require.Equal(t, true, ok)
+	require.Equal(t, tthl.TreeHash(), tth)
+	require.NoError(t, hc.end())
+
+	l, err := tiger.LeavesLoadFromFile(hc.leavesPath(tth))
+	require.NoError(t, err)
+	require.Equal(t, tthl, l)
+
+	// entries of modified files are removed
+	err = os.WriteFile(fpath, []byte(strings.Repeat("B", 100)), 0o644)
+	require.NoError(t, err)
+	require.NoError(t, hc.begin())
+	require.NoError(t, hc.end())
+	_, err = os.Stat(hc.leavesPath(tth))
+	require.Error(t, err)
+}
+
+func TestShareIndexErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-indexerrors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "share"), 0o755)
+	os.WriteFile(filepath.Join(dir, "share", "file.txt"), []byte("test"), 0o644)
+	os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "share", "dangling"))
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+	})
+	require.NoError(t, err)
+
+	var errorPaths []string
+	client.OnShareIndexError = func(path string, err error) {
+		errorPaths = append(errorPaths, path)
+	}
+
+	var summary ShareIndexSummary
+	client.OnShareIndexed = func(s ShareIndexSummary) {
+		summary = s
+	}
+
+	client.shareRoots["share"] = &shareRoot{path: filepath.Join(dir, "share")}
+	client.shareRoots["missing"] = &shareRoot{path: filepath.Join(dir, "missing")}
+	client.shareIndexer.index()
+
+	require.Equal(t, ShareIndexSummary{
+		FileCount:   1,
+		Size:        4,
+		ErrorCount:  2,
+		FailedRoots: []string{"missing"},
+	}, summary)
+	require.ElementsMatch(t, []string{
+		filepath.Join(dir, "share", "dangling"),
+		filepath.Join(dir, "missing"),
+	}, errorPaths)
+	require.Equal(t, 1, len(client.shareTree))
+}
+
+func TestShareWatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-sharewatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "folder"), 0o755)
+	os.WriteFile(filepath.Join(dir, "folder", "first.txt"), []byte("test"), 0o644)
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		ShareWatch:       true,
+	})
+	require.NoError(t, err)
+
+	step := 0
+	client.OnInitialized = func() {
+		client.ShareAdd("share", dir)
+	}
+	client.OnShareIndexed = func(s ShareIndexSummary) {
+		switch step {
+		case 0:
+			require.Equal(t, uint(1), s.FileCount)
+			os.WriteFile(filepath.Join(dir, "folder", "second.txt"), []byte("test2"), 0o644)
+
+		case 1:
+			require.Equal(t, uint(2), s.FileCount)
+			require.Equal(t, uint64(9), s.Size)
+			require.NotNil(t, client.shareTree["share"].dirs["folder"].files["second.txt"])
+			os.RemoveAll(filepath.Join(dir, "folder"))
+
+		case 2:
+			require.Equal(t, uint(0), s.FileCount)
+			require.Equal(t, 0, len(client.shareTree["share"].dirs))
+			client.Close()
+		}
+		step++
+	}
+
+	client.Run()
+	require.Equal(t, 3, step)
+}
+
+func TestShareIndexProgress(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-indexprogress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("A", 100000)), 0o644)
+	}
+
+	client, err := NewClient(ClientConf{
+		LogLevel:          log.LevelError,
+		HubManualConnect:  true,
+		Nick:              "testdctk",
+		IsPassive:         true,
+		ShareHashWorkers:  2,
+		ShareHashMaxSpeed: 1000000,
+	})
+	require.NoError(t, err)
+
+	var lastProgress [4]uint64
+	client.OnShareIndexProgress = func(filesDone uint, filesTotal uint, bytesDone uint64, bytesTotal uint64) {
+		lastProgress = [4]uint64{uint64(filesDone), uint64(filesTotal), bytesDone, bytesTotal}
+	}
+
+	var summary ShareIndexSummary
+	client.OnShareIndexed = func(s ShareIndexSummary) {
+		summary = s
+	}
+
+	client.shareRoots["share"] = &shareRoot{path: dir}
+	start := time.Now()
+	client.shareIndexer.index()
+
+	// 300KB at 1MB/s
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Equal(t, [4]uint64{3, 3, 300000, 300000}, lastProgress)
+	require.Equal(t, uint(3), summary.FileCount)
+	require.Equal(t, uint64(300000), summary.Size)
+	tth := tiger.HashFromBytes([]byte(strings.Repeat("A", 100000)))
+	require.Equal(t, tth, client.shareTree["share"].files["a.txt"].tth)
+
+	// files with the same content are indexed by TTH together
+	require.Equal(t, 3, len(client.shareByTTH[tth]))
+	require.NotNil(t, client.shareFileByTTH(tth))
+}
+
+func TestShareConf(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-shareconf")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, ".git"), 0o755)
+	os.WriteFile(filepath.Join(dir, ".git", "config"), []byte("test"), 0o644)
+	os.Mkdir(filepath.Join(dir, "folder"), 0o755)
+	os.WriteFile(filepath.Join(dir, "folder", "song.mp3"), []byte("test"), 0o644)
+	os.WriteFile(filepath.Join(dir, "folder", "song.txt"), []byte("test"), 0o644)
+	os.WriteFile(filepath.Join(dir, "folder", "big.mp3"), []byte(strings.Repeat("A", 1000)), 0o644)
+	os.WriteFile(filepath.Join(dir, "folder", "partial.mp3.tmp"), []byte("test"), 0o644)
+	os.Mkdir(filepath.Join(dir, "excluded"), 0o755)
+	os.WriteFile(filepath.Join(dir, "excluded", "song.mp3"), []byte("test"), 0o644)
+	os.Symlink(dir, filepath.Join(dir, "folder", "loop"))
+	os.Symlink(filepath.Join(dir, "folder"), filepath.Join(dir, "link"))
+	os.Mkdir(filepath.Join(dir, "sibling1"), 0o755)
+	os.WriteFile(filepath.Join(dir, "sibling1", "song.mp3"), []byte("test"), 0o644)
+	os.Mkdir(filepath.Join(dir, "sibling2"), 0o755)
+	os.Symlink(filepath.Join(dir, "sibling2"), filepath.Join(dir, "sibling1", "link2"))
+	os.Symlink(filepath.Join(dir, "sibling1"), filepath.Join(dir, "sibling2", "link1"))
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+	})
+	require.NoError(t, err)
+
+	var errorPaths []string
+	client.OnShareIndexError = func(path string, err error) {
+		errorPaths = append(errorPaths, path)
+	}
+
+	client.shareRoots["share"] = &shareRoot{
+		path: dir,
+		conf: ShareConf{
+			Include:       []string{"*.mp3"},
+			ExcludeRegexp: []*regexp.Regexp{regexp.MustCompile("^excluded$")},
+			SkipHidden:    true,
+			MaxSize:       100,
+		},
+	}
+	client.shareIndexer.index()
+
+	tree := client.shareTree["share"]
+	require.Equal(t, []string{"folder", "sibling1"}, func() []string {
+		var names []string
+		for name := range tree.dirs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}())
+	require.Equal(t, 1, len(tree.dirs["folder"].files))
+	require.NotNil(t, tree.dirs["folder"].files["song.mp3"])
+
+	// directories that point to each other are shared once
+	require.Equal(t, 1, len(tree.dirs["sibling1"].files))
+	require.Equal(t, 0, len(tree.dirs["sibling1"].dirs["link2"].dirs))
+	require.Equal(t, uint(2), client.shareCount)
+
+	require.Equal(t, []string{
+		filepath.Join(dir, "folder", "loop"),
+		filepath.Join(dir, "link"),
+		filepath.Join(dir, "sibling1", "link2", "link1"),
+		filepath.Join(dir, "sibling2"),
+	}, func() []string {
+		sort.Strings(errorPaths)
+		return errorPaths
+	}())
+
+	client.shareRoots["share"] = &shareRoot{
+		path: dir,
+		conf: ShareConf{SkipSymlinks: true},
+	}
+	client.shareIndexer.index()
+	require.Nil(t, client.shareTree["share"].dirs["link"])
+	require.Equal(t, 3, len(client.shareTree["share"].dirs["folder"].files))
+
+	err = client.ShareAdd("share", dir, ShareConf{Exclude: []string{"[a"}})
+	require.Error(t, err)
+}
+
+func TestShareUpdateConf(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dctk-shareupdate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "folder"), 0o755)
+	os.WriteFile(filepath.Join(dir, "folder", "song.mp3"), []byte("test"), 0o644)
+	os.WriteFile(filepath.Join(dir, "folder", "song.txt"), []byte("test2"), 0o644)
+	os.Symlink(filepath.Join(dir, "folder"), filepath.Join(dir, "link"))
+
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		HubManualConnect: true,
+		Nick:             "testdctk",
+		IsPassive:        true,
+	})
+	require.NoError(t, err)
+
+	client.shareRoots["share"] = &shareRoot{path: dir}
+	client.shareIndexer.index()
+	require.NotNil(t, client.shareTree["share"].dirs["folder"])
+	require.Nil(t, client.shareTree["share"].dirs["link"])
+
+	// subdirectories that are not scanned again are still shared once
+	client.shareIndexer.update(map[string]struct{}{dir: {}})
+	require.NotNil(t, client.shareTree["share"].dirs["folder"])
+	require.Nil(t, client.shareTree["share"].dirs["link"])
+	require.Equal(t, uint(2), client.shareCount)
+
+	// the configuration is applied to files that are not scanned again
+	client.shareRoots["share"].conf.Exclude = []string{"*.txt"}
+	client.shareIndexer.update(map[string]struct{}{dir: {}})
+	require.Equal(t, 1, len(client.shareTree["share"].dirs["folder"].files))
+	require.Equal(t, uint(1), client.shareCount)
+	require.Equal(t, uint64(4), client.shareSize)
+}
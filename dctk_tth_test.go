@@ -51,3 +51,33 @@ func TestTigerLeavesSave(t *testing.T) {
 		require.Equal(t, c.b, b)
 	}
 }
+
+func TestTigerLeavesBlockSize(t *testing.T) {
+	data := make([]byte, 10*1024+5)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	base, err := tiger.LeavesFromBytes(data)
+	require.NoError(t, err)
+	bs, err := base.BlockSize(uint64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), bs)
+
+	// leaves of an upper level are the TTHs of the blocks they cover
+	var upper tiger.Leaves
+	for i := 0; i < len(data); i += 4096 {
+		end := i + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		upper = append(upper, tiger.HashFromBytes(data[i:end]))
+	}
+	require.Equal(t, base.TreeHash(), upper.TreeHash())
+	bs, err = upper.BlockSize(uint64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), bs)
+
+	_, err = upper.BlockSize(100 * 1024)
+	require.Error(t, err)
+}
@@ -0,0 +1,397 @@
+package dctk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/go-dc/adc"
+	"github.com/aler9/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protoadc"
+	"github.com/aler9/dctk/pkg/protonmdc"
+)
+
+// testUploadEnv is a client that shares the given files and is connected to
+// a hub for each protocol, in order to test uploads.
+type testUploadEnv struct {
+	client *Client
+	hubs   map[protocolName]*Hub
+}
+
+func newTestUploadEnv(t *testing.T, conf ClientConf, files map[string]string) *testUploadEnv {
+	conf.LogLevel = log.LevelError
+	conf.IsPassive = true
+	conf.HubManualConnect = true
+	conf.Nick = "client"
+	client, err := NewClient(conf)
+	require.NoError(t, err)
+
+	e := &testUploadEnv{
+		client: client,
+		hubs:   make(map[protocolName]*Hub),
+	}
+
+	for proto, u := range map[protocolName]string{
+		protocolADC:  "adc://127.0.0.1:1",
+		protocolNMDC: "nmdc://127.0.0.1:1",
+	} {
+		h, err := client.HubAdd(u, "", "")
+		require.NoError(t, err)
+		h.conn = &testConn{}
+		e.hubs[proto] = h
+	}
+
+	if files != nil {
+		dir := t.TempDir()
+		for name, content := range files {
+			fpath := filepath.Join(dir, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0o755))
+			require.NoError(t, os.WriteFile(fpath, []byte(content), 0o644))
+		}
+		client.shareRoots["share"] = &shareRoot{path: dir}
+		client.shareIndexer.index()
+	}
+
+	return e
+}
+
+// peerConn connects a peer to the hub of the given protocol, if it is not
+// connected yet, and returns a new connection with it.
+func (e *testUploadEnv) peerConn(proto protocolName, nick string) (*peerConn, *testConn) {
+	h := e.hubs[proto]
+	p := h.peerByNick(nick)
+	if p == nil {
+		p = &Peer{Hub: h, Nick: nick}
+		e.client.handlePeerConnected(p)
+	}
+
+	tc := &testConn{}
+	return &peerConn{
+		client:  e.client,
+		hub:     h,
+		proto:   proto,
+		conn:    tc,
+		peer:    p,
+		limiter: newRateLimiter(0),
+	}, tc
+}
+
+// query returns the query of a shared file, given its path inside the share.
+func (e *testUploadEnv) query(fpath string) string {
+	dir := e.client.shareTree["share"]
+	parts := strings.Split(fpath, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = dir.dirs[part]
+	}
+	return "file TTH/" + dir.files[parts[len(parts)-1]].tth.String()
+}
+
+func TestUploadQueue(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{
+		UploadMaxParallel:      1,
+		UploadDisableMiniSlots: true,
+	}, nil)
+	client := e.client
+
+	pconn1, _ := e.peerConn(protocolADC, "peer1")
+	require.True(t, newUpload(client, pconn1, "file files.xml.bz2", 0, -1, false))
+
+	// slots are full, peers are queued
+	pconn2, tc2 := e.peerConn(protocolADC, "peer2")
+	require.False(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+	msg := tc2.msgs[0].(*protoadc.AdcCStatusQueued)
+	require.Equal(t, 1, msg.Msg.Position)
+
+	pconn3, tc3 := e.peerConn(protocolNMDC, "peer3")
+	require.False(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 2}, tc3.msgs[0])
+
+	queue := client.UploadQueue()
+	require.Equal(t, 2, len(queue))
+	require.Equal(t, "peer2", queue[0].Peer.Nick)
+	require.Equal(t, "peer3", queue[1].Peer.Nick)
+
+	// the free slot is granted to the peer that is waiting since the longest time
+	pconn1.transfer.handleExit(nil)
+	require.False(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 2}, tc3.msgs[1])
+	require.True(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, 1, len(client.UploadQueue()))
+
+	// peers that do not request again are removed
+	client.uploadQueue[0].LastRequest = time.Now().Add(-client.conf.UploadQueueTimeout)
+	require.Equal(t, 0, len(client.UploadQueue()))
+}
+
+func TestUploadMiniSlots(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{
+		UploadMaxParallel:  1,
+		UploadMiniSlots:    1,
+		UploadMiniSlotSize: 100,
+	}, map[string]string{
+		"small.txt": "small",
+		"big.txt":   strings.Repeat("A", 1000),
+	})
+	client := e.client
+
+	// big files use normal slots
+	pconn1, _ := e.peerConn(protocolADC, "peer1")
+	require.True(t, newUpload(client, pconn1, e.query("big.txt"), 0, -1, false))
+	require.False(t, pconn1.transfer.(*Upload).isMiniSlot)
+	pconn2, _ := e.peerConn(protocolADC, "peer2")
+	require.False(t, newUpload(client, pconn2, e.query("big.txt"), 0, -1, false))
+
+	// file lists and small files use mini-slots
+	pconn3, _ := e.peerConn(protocolADC, "peer3")
+	require.True(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	require.True(t, pconn3.transfer.(*Upload).isMiniSlot)
+	pconn4, _ := e.peerConn(protocolADC, "peer4")
+	require.False(t, newUpload(client, pconn4, e.query("small.txt"), 0, -1, false))
+	require.Equal(t, 2, len(client.UploadQueue()))
+
+	pconn3.transfer.handleExit(nil)
+	require.True(t, newUpload(client, pconn4, e.query("small.txt"), 0, -1, false))
+	require.True(t, pconn4.transfer.(*Upload).isMiniSlot)
+	require.Equal(t, 1, len(client.UploadQueue()))
+
+	pconn1.transfer.handleExit(nil)
+	pconn4.transfer.handleExit(nil)
+	require.Equal(t, uint(1), client.uploadSlotAvail)
+	require.Equal(t, uint(1), client.uploadMiniSlotAvail)
+}
+
+func TestUploadGrantedSlots(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{
+		UploadMaxParallel:      1,
+		UploadDisableMiniSlots: true,
+	}, nil)
+	client := e.client
+
+	pconn1, _ := e.peerConn(protocolADC, "peer1")
+	require.True(t, newUpload(client, pconn1, "file files.xml.bz2", 0, -1, false))
+
+	// granted slots do not use normal slots
+	pconn2, _ := e.peerConn(protocolADC, "peer2")
+	require.False(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+	client.GrantSlot(pconn2.peer, time.Minute)
+	require.True(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, 0, len(client.UploadQueue()))
+	pconn2.transfer.handleExit(nil)
+	require.Equal(t, uint(0), client.uploadSlotAvail)
+
+	// expired slots are not used
+	client.grantedSlots[hubNickPair{hub: pconn2.peer.Hub, nick: pconn2.peer.Nick}] = time.Now()
+	require.False(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+
+	// favorites with auto grant
+	pconn3, _ := e.peerConn(protocolNMDC, "peer3")
+	fav := client.FavoriteAdd(pconn3.peer)
+	require.False(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	fav.SetAutoGrant(true)
+	require.True(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+}
+
+func TestFavorites(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "favorites.json")
+
+	e := newTestUploadEnv(t, ClientConf{FavoritesFile: fpath}, nil)
+	client := e.client
+
+	h := e.hubs[protocolADC]
+	peer1 := &Peer{Hub: h, Nick: "peer1"}
+	peer1.adcClientID[0] = 1
+	peer2 := &Peer{Hub: h, Nick: "peer2"}
+
+	var events []string
+	client.OnFavoriteOnline = func(fav *FavoriteUser, p *Peer) {
+		events = append(events, "on "+fav.Nick)
+	}
+	client.OnFavoriteOffline = func(fav *FavoriteUser, p *Peer) {
+		events = append(events, "off "+fav.Nick)
+	}
+
+	fav := client.FavoriteAdd(peer1)
+	require.Equal(t, fav, client.FavoriteAdd(peer1))
+	fav.SetAutoGrant(true)
+
+	client.handlePeerConnected(peer1)
+	client.handlePeerConnected(peer2)
+	require.Equal(t, []*Peer{peer1}, fav.Peers())
+
+	// users are recognized by CID even if they change nick
+	client.handlePeerDisconnected(peer1)
+	renamed := &Peer{Hub: h, Nick: "renamed", adcClientID: peer1.adcClientID}
+	client.handlePeerConnected(renamed)
+	require.Equal(t, []string{"on peer1", "off peer1", "on peer1"}, events)
+
+	// favorites are persistent
+	client2 := newTestUploadEnv(t, ClientConf{FavoritesFile: fpath}, nil).client
+	require.Equal(t, 1, len(client2.Favorites()))
+	require.Equal(t, "peer1", client2.Favorites()[0].Nick)
+	require.Equal(t, peer1.adcClientID, client2.Favorites()[0].CID)
+	require.True(t, client2.Favorites()[0].AutoGrant)
+
+	client2.FavoriteDel(client2.Favorites()[0])
+	client3 := newTestUploadEnv(t, ClientConf{FavoritesFile: fpath}, nil).client
+	require.Equal(t, 0, len(client3.Favorites()))
+}
+
+func TestUploadEvents(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{}, map[string]string{"file.txt": "0123456789"})
+	client := e.client
+	query := e.query("file.txt")
+
+	var events []string
+	client.OnUploadStarted = func(u *Upload) {
+		events = append(events, "started "+u.Peer().Nick)
+	}
+	client.OnUploadFinished = func(u *Upload) {
+		events = append(events, "finished "+u.Peer().Nick)
+	}
+	client.OnUploadError = func(u *Upload, err error) {
+		events = append(events, "error "+u.Peer().Nick+": "+err.Error())
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go io.Copy(io.Discard, c2) //nolint:errcheck
+
+	pconn1, _ := e.peerConn(protocolADC, "peer1")
+	pconn1.conn = protoadc.NewConn(log.LevelError, "peer1", c1, false, false)
+	require.True(t, newUpload(client, pconn1, query, 2, 5, false))
+	u := pconn1.transfer.(*Upload)
+	require.Equal(t, []*Upload{u}, client.Uploads())
+	require.Equal(t, query, u.Query())
+	require.Equal(t, uint64(2), u.Start())
+	require.Equal(t, uint64(5), u.Length())
+
+	require.NoError(t, u.handleUpload())
+	require.Equal(t, uint64(5), u.Offset())
+	u.handleExit(nil)
+
+	pconn2, _ := e.peerConn(protocolADC, "peer2")
+	require.True(t, newUpload(client, pconn2, query, 0, -1, false))
+	pconn2.transfer.handleExit(fmt.Errorf("connection reset"))
+
+	require.Equal(t, 0, len(client.Uploads()))
+	require.Equal(t, []string{
+		"started peer1",
+		"finished peer1",
+		"started peer2",
+		"error peer2: connection reset",
+	}, events)
+}
+
+func TestUploadAuthorizer(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{}, map[string]string{
+		"public.txt":         "public",
+		"private/secret.txt": "secret",
+	})
+	client := e.client
+	publicQuery := e.query("public.txt")
+	privateQuery := e.query("private/secret.txt")
+
+	var paths []string
+	client.UploadAuthorizer = func(req *UploadRequest) (UploadDecision, string) {
+		paths = append(paths, req.Path)
+		switch {
+		case req.Peer.Nick == "waiting":
+			return UploadEnqueue, ""
+		case req.Peer.Nick != "friend" && strings.HasPrefix(req.Path, "/share/private/"):
+			return UploadDeny, "Private directory"
+		}
+		return UploadAllow, ""
+	}
+
+	pconn1, _ := e.peerConn(protocolADC, "friend")
+	require.True(t, newUpload(client, pconn1, privateQuery, 0, -1, false))
+	pconn1.transfer.handleExit(nil)
+
+	pconn2, tc2 := e.peerConn(protocolADC, "stranger")
+	require.True(t, newUpload(client, pconn2, publicQuery, 0, -1, false))
+	pconn2.transfer.handleExit(nil)
+	require.False(t, newUpload(client, pconn2, privateQuery, 0, -1, false))
+	msg := tc2.msgs[len(tc2.msgs)-1].(*protoadc.AdcCStatus)
+	require.Equal(t, protoadc.AdcCodeTransferGeneric, msg.Msg.Code)
+	require.Equal(t, "Private directory", msg.Msg.Msg)
+
+	pconn3, tc3 := e.peerConn(protocolNMDC, "stranger")
+	require.False(t, newUpload(client, pconn3, privateQuery, 0, -1, false))
+	require.Equal(t, "Private directory", tc3.msgs[0].(*nmdc.Error).Err.Error())
+
+	// peers can be put in queue even if slots are available
+	pconn4, tc4 := e.peerConn(protocolNMDC, "waiting")
+	require.False(t, newUpload(client, pconn4, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 1}, tc4.msgs[0])
+
+	require.Equal(t, []string{
+		"/share/private/secret.txt",
+		"/share/public.txt",
+		"/share/private/secret.txt",
+		"/share/private/secret.txt",
+		"",
+	}, paths)
+}
+
+func TestUploadAuthorizerQueue(t *testing.T) {
+	e := newTestUploadEnv(t, ClientConf{
+		UploadMaxParallel:      1,
+		UploadDisableMiniSlots: true,
+	}, nil)
+	client := e.client
+	client.UploadAuthorizer = func(req *UploadRequest) (UploadDecision, string) {
+		if req.Peer.Nick == "waiting" {
+			return UploadEnqueue, ""
+		}
+		return UploadAllow, ""
+	}
+
+	pconn1, tc1 := e.peerConn(protocolNMDC, "waiting")
+	require.False(t, newUpload(client, pconn1, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 1}, tc1.msgs[0])
+
+	// peers held by the authorizer do not take the free slot
+	pconn2, _ := e.peerConn(protocolNMDC, "peer2")
+	require.True(t, newUpload(client, pconn2, "file files.xml.bz2", 0, -1, false))
+
+	// and are placed after the peers that are waiting for a slot
+	pconn3, tc3 := e.peerConn(protocolNMDC, "peer3")
+	require.False(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 1}, tc3.msgs[0])
+	require.False(t, newUpload(client, pconn1, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, &protonmdc.NmdcMaxedOut{Position: 2}, tc1.msgs[1])
+
+	pconn2.transfer.handleExit(nil)
+	require.True(t, newUpload(client, pconn3, "file files.xml.bz2", 0, -1, false))
+	require.Equal(t, 1, len(client.UploadQueue()))
+}
+
+func TestUploadQueueMessages(t *testing.T) {
+	pkt := &adc.ClientPacket{}
+	pkt.SetMessage(&protoadc.AdcStatusQueued{
+		Status: adc.Status{
+			Sev:  adc.Recoverable,
+			Code: protoadc.AdcCodeSlotsFull,
+			Msg:  "Slots full",
+		},
+		Position: 3,
+	})
+	var buf bytes.Buffer
+	require.NoError(t, pkt.MarshalPacketADC(&buf))
+	require.Equal(t, "CSTA 153 Slots\\sfull QP3\n", buf.String())
+
+	var m protonmdc.NmdcMaxedOut
+	require.NoError(t, m.UnmarshalNMDC(nil, []byte("3")))
+	require.Equal(t, uint(3), m.Position)
+	require.NoError(t, m.UnmarshalNMDC(nil, nil))
+	require.Equal(t, uint(0), m.Position)
+}
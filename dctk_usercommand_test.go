@@ -0,0 +1,136 @@
+package dctk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+type testRawConn struct {
+	conn
+	raw []string
+}
+
+func (c *testRawConn) WriteRaw(in []byte) {
+	c.raw = append(c.raw, string(in))
+}
+
+func TestUserCommandRun(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		proto   protocolName
+		command string
+		params  map[string]string
+		out     string
+		err     string
+	}{
+		{
+			"adc nicks",
+			protocolADC,
+			"HMSG %[myNI]\\s%[userNI]",
+			nil,
+			"HMSG my\\snick\\sa\\s\\\\b\\n\n",
+			"",
+		},
+		{
+			"adc line",
+			protocolADC,
+			"HMSG reason:\\s%[line:Reason]\n",
+			map[string]string{"Reason": "too slow\nbye"},
+			"HMSG reason:\\stoo\\sslow\\nbye\n",
+			"",
+		},
+		{
+			"adc missing line",
+			protocolADC,
+			"HMSG %[line:Reason]",
+			nil,
+			"",
+			"missing parameter: Reason",
+		},
+		{
+			"nmdc nicks",
+			protocolNMDC,
+			"<%[mynick]> !kick %[nick]",
+			nil,
+			"<my nick> !kick a \\b\n|",
+			"",
+		},
+		{
+			"nmdc line",
+			protocolNMDC,
+			"<%[myNI]> !ban %[userNI] %[line:Reason]|",
+			map[string]string{"Reason": "costs $5|day"},
+			"<my nick> !ban a \\b\n costs &#36;5&#124;day|",
+			"",
+		},
+		{
+			"nmdc missing line",
+			protocolNMDC,
+			"<%[myNI]> %[line:Reason] %[line:Time]",
+			map[string]string{"Reason": "spam"},
+			"",
+			"missing parameter: Time",
+		},
+		{
+			"unknown placeholder",
+			protocolNMDC,
+			"<%[myNI]> %[unknown] %[custom]",
+			map[string]string{"custom": "value"},
+			"<my nick> %[unknown] value|",
+			"",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			client, err := NewClient(ClientConf{
+				LogLevel:         log.LevelError,
+				Nick:             "my nick",
+				IsPassive:        true,
+				HubManualConnect: true,
+			})
+			require.NoError(t, err)
+
+			h := &Hub{client: client, nick: "my nick", state: hubInitialized}
+			h.setProto(ca.proto)
+			tc := &testRawConn{}
+			h.conn = tc
+
+			cmd := &UserCommand{Hub: h, Name: "cmd", Command: ca.command}
+			peer := &Peer{Hub: h, Nick: "a \\b\n"}
+
+			err = client.RunUserCommand(cmd, peer, ca.params)
+			if ca.err != "" {
+				require.EqualError(t, err, ca.err)
+				require.Equal(t, 0, len(tc.raw))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{ca.out}, tc.raw)
+		})
+	}
+}
+
+func TestUserCommandRunErrors(t *testing.T) {
+	client, err := NewClient(ClientConf{
+		LogLevel:         log.LevelError,
+		Nick:             "testdctk",
+		IsPassive:        true,
+		HubManualConnect: true,
+	})
+	require.NoError(t, err)
+
+	h := &Hub{client: client, nick: "testdctk", state: hubConnected}
+	h2 := &Hub{client: client, nick: "testdctk", state: hubInitialized}
+
+	err = client.RunUserCommand(&UserCommand{Hub: h, Command: "cmd"}, nil, nil)
+	require.EqualError(t, err, "hub is not connected")
+
+	h.state = hubInitialized
+	err = client.RunUserCommand(&UserCommand{Hub: h, Separator: true}, nil, nil)
+	require.EqualError(t, err, "command is a separator")
+
+	err = client.RunUserCommand(&UserCommand{Hub: h, Command: "cmd"}, &Peer{Hub: h2}, nil)
+	require.EqualError(t, err, "peer does not belong to the hub of the command")
+}
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/aler9/dctk/pkg/protocommon"
 )
 
 var dockerIP = func() string {
@@ -26,6 +28,16 @@ var dockerIP = func() string {
 	return ""
 }()
 
+// testConn is a connection that records the messages written to it.
+type testConn struct {
+	conn
+	msgs []protocommon.MsgEncodable
+}
+
+func (c *testConn) Write(msg protocommon.MsgEncodable) {
+	c.msgs = append(c.msgs, msg)
+}
+
 type externalHubDef struct {
 	name  string
 	proto string
@@ -16,6 +16,7 @@ import (
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/protoadc"
 	"github.com/aler9/dctk/pkg/protocommon"
+	"github.com/aler9/dctk/pkg/protonmdc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
@@ -23,6 +24,12 @@ const (
 	peerWaitPeriod = 10 * time.Second
 )
 
+// errors that mean that the peer is not able to provide the file
+var (
+	errorFileNotAvailable = fmt.Errorf("file not available")
+	errorValidationFailed = fmt.Errorf("validation failed")
+)
+
 // DownloadConf allows to configure a download.
 type DownloadConf struct {
 	// the peer from which downloading
@@ -37,8 +44,15 @@ type DownloadConf struct {
 	SavePath string
 	// after download, do not attempt to validate the file through its TTH
 	SkipValidation bool
+	// do not attempt to resume a partial download found in SavePath + ".tmp".
+	// Resuming is performed only when the entire file is requested
+	SkipResume bool
 
 	isFilelist bool
+	isTTHL     bool
+	priority   DownloadPriority
+	// if set, it is called when the download exits, instead of the client callbacks
+	onExit func(d *Download, err error)
 }
 
 // Download represents an in-progress file download.
@@ -50,8 +64,11 @@ type Download struct {
 	state              string
 	activeDlChan       chan struct{}
 	slotChan           chan struct{}
+	hubChan            chan error
 	peerChan           chan struct{}
+	slotTaken          bool
 	pconn              *peerConn
+	resumeOffset       uint64
 	query              string
 	adcToken           string
 	writer             io.WriteCloser
@@ -86,7 +103,7 @@ func (c *Client) downloadByAdcToken(adcToken string) *Download {
 }
 
 func (c *Client) downloadPendingByPeer(peer *Peer) *Download {
-	dl, ok := c.activeDownloadsByPeer[peer.Nick]
+	dl, ok := c.activeDownloadsByPeer[hubNickPair{peer.Hub, peer.Nick}]
 	if ok && !dl.terminateRequested && dl.state == "waiting_peer" {
 		return dl
 	}
@@ -149,6 +166,7 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 		state:        "uninitialized",
 		activeDlChan: make(chan struct{}),
 		slotChan:     make(chan struct{}),
+		hubChan:      make(chan error),
 		peerChan:     make(chan struct{}),
 	}
 	d.client.transfers[d] = struct{}{}
@@ -158,6 +176,9 @@ func (c *Client) DownloadFile(conf DownloadConf) (*Download, error) {
 		if d.conf.isFilelist {
 			return "file files.xml.bz2"
 		}
+		if d.conf.isTTHL {
+			return "tthl TTH/" + d.conf.TTH.String()
+		}
 		return "file TTH/" + d.conf.TTH.String()
 	}()
 
@@ -198,15 +219,24 @@ func (d *Download) do() {
 	defer d.client.wg.Done()
 
 	err := func() error {
+		// check if a partial download exists and eventually resume it
+		if d.conf.SavePath != "" && !d.conf.SkipResume && !d.conf.isFilelist &&
+			!d.conf.isTTHL && d.conf.Start == 0 && d.conf.Length <= 0 {
+			err := d.prepareResume()
+			if err != nil {
+				return err
+			}
+		}
+
 		// check if there are other downloads active on peer and eventually wait
 		wait := false
 		d.client.Safe(func() {
-			if _, ok := d.client.activeDownloadsByPeer[d.conf.Peer.Nick]; ok {
+			if _, ok := d.client.activeDownloadsByPeer[hubNickPair{d.conf.Peer.Hub, d.conf.Peer.Nick}]; ok {
 				d.state = "waiting_activedl"
 				wait = true
 			} else {
 				d.state = "waited_activedl"
-				d.client.activeDownloadsByPeer[d.conf.Peer.Nick] = d
+				d.client.activeDownloadsByPeer[hubNickPair{d.conf.Peer.Hub, d.conf.Peer.Nick}] = d
 			}
 		})
 		if wait {
@@ -217,6 +247,26 @@ func (d *Download) do() {
 			}
 		}
 
+		// check if hub is connected and eventually wait. This is done before
+		// taking a slot, in order not to hold it while the hub is reconnecting
+		wait = false
+		d.client.Safe(func() {
+			if d.conf.Peer.Hub.state != hubInitialized {
+				d.state = "waiting_hub"
+				wait = true
+			}
+		})
+		if wait {
+			select {
+			case <-d.terminate:
+				return protocommon.ErrorTerminated
+			case err := <-d.hubChan:
+				if err != nil {
+					return err
+				}
+			}
+		}
+
 		// check if there is a download slot available and eventually wait
 		wait = false
 		d.client.Safe(func() {
@@ -225,6 +275,7 @@ func (d *Download) do() {
 				wait = true
 			} else {
 				d.state = "waited_slot"
+				d.slotTaken = true
 				d.client.downloadSlotAvail--
 			}
 		})
@@ -238,12 +289,20 @@ func (d *Download) do() {
 
 		// check if there is a connection with peer and eventually wait
 		wait = false
+		var err error
 		d.client.Safe(func() {
-			if pconn, ok := d.client.peerConnsByKey[nickDirectionPair{d.conf.Peer.Nick, "download"}]; !ok {
+			// peer may have disconnected while waiting
+			if d.conf.Peer.Hub.peerByNick(d.conf.Peer.Nick) == nil {
+				err = fmt.Errorf("peer is not connected")
+				return
+			}
+
+			key := nickDirectionPair{d.conf.Peer.Hub, d.conf.Peer.Nick, "download"}
+			if pconn, ok := d.client.peerConnsByKey[key]; !ok {
 				log.Log(d.client.conf.LogLevel, log.LevelDebug, "[download] [%s] requesting new connection", d.conf.Peer.Nick)
 
 				// generate new token
-				if d.client.protoIsAdc() {
+				if d.conf.Peer.Hub.protoIsAdc() {
 					d.adcToken = protoadc.AdcRandomToken()
 				}
 
@@ -258,6 +317,9 @@ func (d *Download) do() {
 				d.state = "processing"
 			}
 		})
+		if err != nil {
+			return err
+		}
 		if wait {
 			select {
 			case <-time.After(peerWaitPeriod):
@@ -271,14 +333,14 @@ func (d *Download) do() {
 		// process download
 		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] processing", d.conf.Peer.Nick)
 
-		if d.client.protoIsAdc() {
+		if d.pconn.protoIsAdc() {
 			queryParts := strings.Split(d.query, " ")
 			d.pconn.conn.Write(&protoadc.AdcCGetFile{ //nolint:govet
 				&adc.ClientPacket{},
 				&adc.GetRequest{
 					Type:  queryParts[0],
 					Path:  queryParts[1],
-					Start: int64(d.conf.Start),
+					Start: int64(d.conf.Start + d.resumeOffset),
 					Bytes: d.conf.Length,
 					Compressed: (!d.client.conf.PeerDisableCompression &&
 						(d.conf.Length <= 0 || d.conf.Length >= (1024*10))),
@@ -289,7 +351,7 @@ func (d *Download) do() {
 			d.pconn.conn.Write(&nmdc.ADCGet{
 				ContentType: nmdc.String(queryParts[0]),
 				Identifier:  nmdc.String(queryParts[1]),
-				Start:       d.conf.Start,
+				Start:       d.conf.Start + d.resumeOffset,
 				Length:      d.conf.Length,
 				Compressed: (!d.client.conf.PeerDisableCompression &&
 					(d.conf.Length <= 0 || d.conf.Length >= (1024*10))),
@@ -306,6 +368,134 @@ func (d *Download) do() {
 	}
 }
 
+// prepareResume checks whether a partial file exists, downloads the TTH
+// leaves of the file and computes the part of the partial file that can be kept.
+func (d *Download) prepareResume() error {
+	fpath := d.conf.SavePath + ".tmp"
+	fi, err := os.Stat(fpath)
+	if err != nil || fi.Size() == 0 {
+		return nil
+	}
+
+	log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] found partial file, requesting TTH leaves",
+		d.conf.Peer.Nick)
+
+	done := make(chan error, 1)
+	var leavesDl *Download
+	d.client.Safe(func() {
+		leavesDl, _ = d.client.DownloadFile(DownloadConf{
+			Peer:   d.conf.Peer,
+			TTH:    d.conf.TTH,
+			isTTHL: true,
+			onExit: func(dl *Download, err error) {
+				done <- err
+			},
+		})
+	})
+
+	select {
+	case <-d.terminate:
+		d.client.Safe(func() {
+			leavesDl.Close()
+		})
+		return protocommon.ErrorTerminated
+
+	case err = <-done:
+	}
+
+	offset, err := func() (uint64, error) {
+		if err != nil {
+			return 0, err
+		}
+
+		leaves, err := tiger.LeavesLoadFromBytes(leavesDl.Content())
+		if err != nil {
+			return 0, err
+		}
+		if leaves.TreeHash() != d.conf.TTH {
+			return 0, fmt.Errorf("TTH leaves do not match TTH")
+		}
+
+		return downloadResumeOffset(fpath, leaves)
+	}()
+	if err != nil {
+		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] unable to resume: %s",
+			d.conf.Peer.Nick, err)
+		return nil
+	}
+
+	// discard the part that failed verification
+	err = os.Truncate(fpath, int64(offset))
+	if err != nil {
+		return nil
+	}
+
+	if offset > 0 {
+		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] resuming from %d",
+			d.conf.Peer.Nick, offset)
+	}
+	d.resumeOffset = offset
+	return nil
+}
+
+// downloadResumeOffset returns the length of the prefix of a partial file
+// that matches the TTH leaves.
+func downloadResumeOffset(fpath string, leaves tiger.Leaves) (uint64, error) {
+	// the last leaf cannot be verified since the file size is unknown
+	if len(leaves) < 2 {
+		return 0, nil
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(fi.Size())
+
+	readBlock := func(start uint64, buf []byte) error {
+		_, err := f.ReadAt(buf, int64(start))
+		return err
+	}
+
+	// find the part of file covered by a leaf, by comparing the first leaf
+	// with blocks of increasing size
+	var bs uint64
+	for cur := uint64(1024); cur <= size; cur *= 2 {
+		buf := make([]byte, cur)
+		if err := readBlock(0, buf); err != nil {
+			return 0, err
+		}
+		if tiger.HashFromBytes(buf) == leaves[0] {
+			bs = cur
+			break
+		}
+	}
+	if bs == 0 {
+		return 0, nil
+	}
+
+	// verify blocks until the first corrupted one
+	offset := bs
+	buf := make([]byte, bs)
+	for i := 1; i < (len(leaves)-1) && (offset+bs) <= size; i++ {
+		if err := readBlock(offset, buf); err != nil {
+			return 0, err
+		}
+		if tiger.HashFromBytes(buf) != leaves[i] {
+			break
+		}
+		offset += bs
+	}
+
+	return offset, nil
+}
+
 func (d *Download) handleSendFile(reqQuery string,
 	reqStart uint64,
 	reqLength uint64,
@@ -314,8 +504,8 @@ func (d *Download) handleSendFile(reqQuery string,
 	if reqQuery != d.query {
 		return fmt.Errorf("filename returned by uploader is wrong: %s vs %s", reqQuery, d.query)
 	}
-	if reqStart != d.conf.Start {
-		return fmt.Errorf("uploader returned wrong start: %d instead of %d", reqStart, d.conf.Start)
+	if reqStart != (d.conf.Start + d.resumeOffset) {
+		return fmt.Errorf("uploader returned wrong start: %d instead of %d", reqStart, d.conf.Start+d.resumeOffset)
 	}
 	if reqCompressed && d.client.conf.PeerDisableCompression {
 		return fmt.Errorf("compression is active but is disabled")
@@ -334,6 +524,7 @@ func (d *Download) handleSendFile(reqQuery string,
 		return fmt.Errorf("downloading null files is not supported")
 	}
 
+	d.pconn.limiter.setRate(uint64(d.client.conf.DownloadMaxSpeedPerPeer))
 	d.pconn.conn.SetBinaryMode(true)
 	if reqCompressed {
 		err := d.pconn.conn.EnableReaderZlib()
@@ -344,7 +535,13 @@ func (d *Download) handleSendFile(reqQuery string,
 
 	// save in file
 	if d.conf.SavePath != "" {
-		f, err := os.Create(d.conf.SavePath + ".tmp")
+		var f *os.File
+		var err error
+		if d.resumeOffset > 0 {
+			f, err = os.OpenFile(d.conf.SavePath+".tmp", os.O_WRONLY|os.O_APPEND, 0o644)
+		} else {
+			f, err = os.Create(d.conf.SavePath + ".tmp")
+		}
 		if err != nil {
 			return fmt.Errorf("unable to create destination file")
 		}
@@ -365,16 +562,22 @@ func (d *Download) handleSendFile(reqQuery string,
 func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 	switch msg := msgi.(type) {
 	case *protoadc.AdcCStatus:
+		if msg.Msg.Code == protoadc.AdcCodeFileNotAvailable {
+			return errorFileNotAvailable
+		}
 		return fmt.Errorf("error: %+v", msg)
 
 	case *protoadc.AdcCSendFile:
 		query := msg.Msg.Type + " " + msg.Msg.Path
 		return d.handleSendFile(query, uint64(msg.Msg.Start), uint64(msg.Msg.Bytes), msg.Msg.Compressed)
 
-	case *nmdc.MaxedOut:
+	case *protonmdc.NmdcMaxedOut:
 		return fmt.Errorf("maxed out")
 
 	case *nmdc.Error:
+		if strings.EqualFold(msg.Err.Error(), "File Not Available") {
+			return errorFileNotAvailable
+		}
 		return fmt.Errorf("error: %s", msg.Err)
 
 	case *nmdc.ADCSnd:
@@ -440,7 +643,7 @@ func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 				// normal file
 			} else {
 				// validate
-				if !d.conf.SkipValidation && d.conf.Start == 0 && d.conf.Length <= 0 {
+				if !d.conf.SkipValidation && !d.conf.isTTHL && d.conf.Start == 0 && d.conf.Length <= 0 {
 					log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] validating", d.conf.Peer.Nick)
 
 					// file in disk
@@ -458,7 +661,7 @@ func (d *Download) handleDownload(msgi protocommon.MsgDecodable) error {
 					}
 
 					if contentTTH != d.conf.TTH {
-						return fmt.Errorf("validation failed")
+						return errorValidationFailed
 					}
 				}
 
@@ -487,33 +690,47 @@ func (d *Download) handleExit(err error) {
 	delete(d.client.transfers, d)
 
 	// free activedl and unlock next download
-	delete(d.client.activeDownloadsByPeer, d.conf.Peer.Nick)
-	for rot := range d.client.transfers {
-		if od, ok := rot.(*Download); ok {
-			if !od.terminateRequested && od.state == "waiting_activedl" && d.conf.Peer == od.conf.Peer {
-				od.state = "waited_activedl"
-				od.client.activeDownloadsByPeer[od.conf.Peer.Nick] = d
-				od.activeDlChan <- struct{}{}
-				break
+	key := hubNickPair{d.conf.Peer.Hub, d.conf.Peer.Nick}
+	if d.client.activeDownloadsByPeer[key] == d {
+		delete(d.client.activeDownloadsByPeer, key)
+		for rot := range d.client.transfers {
+			if od, ok := rot.(*Download); ok {
+				if !od.terminateRequested && od.state == "waiting_activedl" &&
+					d.conf.Peer.Hub == od.conf.Peer.Hub && d.conf.Peer.Nick == od.conf.Peer.Nick {
+					od.state = "waited_activedl"
+					od.client.activeDownloadsByPeer[hubNickPair{od.conf.Peer.Hub, od.conf.Peer.Nick}] = od
+					od.activeDlChan <- struct{}{}
+					break
+				}
 			}
 		}
 	}
 
 	// free slot and unlock next download
-	d.client.downloadSlotAvail++
-	for rot := range d.client.transfers {
-		if od, ok := rot.(*Download); ok {
-			if !od.terminateRequested && od.state == "waiting_slot" {
-				od.state = "waited_slot"
-				od.client.downloadSlotAvail--
-				od.slotChan <- struct{}{}
-				break
+	// downloads with higher priority are unlocked first
+	if d.slotTaken {
+		d.client.downloadSlotAvail++
+		var next *Download
+		for rot := range d.client.transfers {
+			if od, ok := rot.(*Download); ok {
+				if !od.terminateRequested && od.state == "waiting_slot" &&
+					(next == nil || od.conf.priority > next.conf.priority) {
+					next = od
+				}
 			}
 		}
+		if next != nil {
+			next.state = "waited_slot"
+			next.slotTaken = true
+			next.client.downloadSlotAvail--
+			next.slotChan <- struct{}{}
+		}
 	}
 
 	// call callbacks
-	if err == nil {
+	if d.conf.onExit != nil {
+		d.conf.onExit(d, err)
+	} else if err == nil {
 		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] finished %s (s=%d l=%d)",
 			d.conf.Peer.Nick, dcReadableQuery(d.query), d.conf.Start, len(d.content))
 		if d.client.OnDownloadSuccessful != nil {
@@ -526,4 +743,7 @@ func (d *Download) handleExit(err error) {
 			d.client.OnDownloadError(d)
 		}
 	}
+
+	// peer may be available for queued downloads
+	d.client.queueSchedule()
 }
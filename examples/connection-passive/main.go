@@ -18,7 +18,7 @@ func main() {
 	}
 
 	// we are connected to the hub
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		fmt.Println("connected to hub")
 	}
 
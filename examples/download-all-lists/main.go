@@ -19,7 +19,7 @@ func main() {
 
 	// when we are connected, start downloading the file list of every other peer
 	// who share at least one byte of files and is not ourself
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		for _, p := range client.Peers() {
 			if p.ShareSize > 0 && p.Nick != client.Conf().Nick {
 				client.DownloadFileList(p, "")
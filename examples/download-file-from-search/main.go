@@ -20,7 +20,7 @@ func main() {
 	}
 
 	// search file by name
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		client.Search(dctk.SearchConf{
 			Query: "ubuntu",
 		})
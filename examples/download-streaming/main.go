@@ -48,7 +48,7 @@ func main() {
 		fileCurPos += chunkLen
 	}
 
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		client.Search(dctk.SearchConf{
 			Type: dctk.SearchTTH,
 			TTH:  fileTTH,
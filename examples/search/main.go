@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aler9/dctk"
 )
@@ -20,17 +21,17 @@ func main() {
 	}
 
 	// hub is connected, start searching
-	client.OnHubConnected = func() {
+	client.OnHubConnected = func(h *dctk.Hub) {
 		// search by name
 		client.Search(dctk.SearchConf{
-			Query: "test",
+			Query:   "test",
+			Timeout: 10 * time.Second,
+			// a search result has been received
+			OnResult: func(r *dctk.SearchResult) {
+				fmt.Printf("result: %+v\n", r)
+			},
 		})
 	}
 
-	// a search result has been received
-	client.OnSearchResult = func(r *dctk.SearchResult) {
-		fmt.Printf("result: %+v\n", r)
-	}
-
 	client.Run()
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/aler9/dctk"
 )
 
@@ -24,9 +26,14 @@ func main() {
 	}
 
 	// wait indexing and connect to hub
-	client.OnShareIndexed = func() {
+	client.OnShareIndexed = func(dctk.ShareIndexSummary) {
 		client.HubConnect()
 	}
 
+	// an upload to a peer has finished
+	client.OnUploadFinished = func(u *dctk.Upload) {
+		fmt.Printf("uploaded %s to %s (%d bytes)\n", u.Query(), u.Peer().Nick, u.Length())
+	}
+
 	client.Run()
 }
@@ -0,0 +1,177 @@
+package dctk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	atypes "github.com/aler9/go-dc/adc/types"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+// FavoriteUser is a user in the favorite list.
+type FavoriteUser struct {
+	// the nickname of the user
+	Nick string
+	// the client ID of the user (ADC only). When available, it is used to
+	// recognize the user instead of the nick
+	CID atypes.CID
+	// whether an upload slot is always granted to the user
+	AutoGrant bool
+
+	client *Client
+}
+
+type favoritesFile struct {
+	Users []*FavoriteUser
+}
+
+func (c *Client) favoritesLoad() error {
+	byts, err := os.ReadFile(c.conf.FavoritesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var ff favoritesFile
+	err = json.Unmarshal(byts, &ff)
+	if err != nil {
+		return fmt.Errorf("unable to load favorites: %s", err)
+	}
+
+	for _, fav := range ff.Users {
+		fav.client = c
+	}
+	c.favorites = ff.Users
+	return nil
+}
+
+func (c *Client) favoritesSave() {
+	if c.conf.FavoritesFile == "" {
+		return
+	}
+
+	byts, err := json.MarshalIndent(favoritesFile{Users: c.favorites}, "", "  ")
+	if err == nil {
+		// write to a temporary file in order not to corrupt the list in case of crash
+		err = os.WriteFile(c.conf.FavoritesFile+".tmp", byts, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(c.conf.FavoritesFile+".tmp", c.conf.FavoritesFile)
+	}
+	if err != nil {
+		log.Log(c.conf.LogLevel, log.LevelInfo, "ERR: unable to save favorites: %s", err)
+	}
+}
+
+// matches checks whether a peer is the favorite user.
+func (fav *FavoriteUser) matches(p *Peer) bool {
+	if !fav.CID.IsZero() && !p.adcClientID.IsZero() {
+		return fav.CID == p.adcClientID
+	}
+	return fav.Nick == p.Nick
+}
+
+// FavoriteAdd adds a peer to the favorite list. If the peer is already
+// a favorite, it is returned.
+func (c *Client) FavoriteAdd(p *Peer) *FavoriteUser {
+	if fav := c.FavoriteByPeer(p); fav != nil {
+		return fav
+	}
+
+	fav := &FavoriteUser{
+		Nick:   p.Nick,
+		CID:    p.adcClientID,
+		client: c,
+	}
+	c.favorites = append(c.favorites, fav)
+	c.favoritesSave()
+	return fav
+}
+
+// FavoriteDel removes a user from the favorite list.
+func (c *Client) FavoriteDel(fav *FavoriteUser) {
+	for i, ofav := range c.favorites {
+		if ofav == fav {
+			c.favorites = append(c.favorites[:i], c.favorites[i+1:]...)
+			c.favoritesSave()
+			return
+		}
+	}
+}
+
+// Favorites returns the users in the favorite list.
+func (c *Client) Favorites() []*FavoriteUser {
+	return c.favorites
+}
+
+// FavoriteByPeer returns the favorite user that corresponds to a peer, if any.
+func (c *Client) FavoriteByPeer(p *Peer) *FavoriteUser {
+	for _, fav := range c.favorites {
+		if fav.matches(p) {
+			return fav
+		}
+	}
+	return nil
+}
+
+// SetAutoGrant sets whether an upload slot is always granted to the user.
+func (fav *FavoriteUser) SetAutoGrant(autoGrant bool) {
+	fav.AutoGrant = autoGrant
+	fav.client.favoritesSave()
+}
+
+// Peers returns the peers that correspond to the user, in all connected hubs.
+func (fav *FavoriteUser) Peers() []*Peer {
+	var ret []*Peer
+	for _, h := range fav.client.hubs {
+		for _, p := range h.peers {
+			if fav.matches(p) {
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret
+}
+
+// GrantSlot grants an additional upload slot to a peer for the given duration.
+// Uploads to the peer are not limited by UploadMaxParallel until the slot
+// expires. A duration of zero means that the slot never expires.
+func (c *Client) GrantSlot(p *Peer, duration time.Duration) {
+	// remove expired slots
+	for key, expiry := range c.grantedSlots {
+		if !expiry.IsZero() && time.Now().After(expiry) {
+			delete(c.grantedSlots, key)
+		}
+	}
+
+	var expiry time.Time
+	if duration != 0 {
+		expiry = time.Now().Add(duration)
+	}
+	c.grantedSlots[hubNickPair{hub: p.Hub, nick: p.Nick}] = expiry
+}
+
+// UngrantSlot removes a slot granted with GrantSlot.
+func (c *Client) UngrantSlot(p *Peer) {
+	delete(c.grantedSlots, hubNickPair{hub: p.Hub, nick: p.Nick})
+}
+
+// hasGrantedSlot checks whether a slot was granted to a peer, manually or
+// through the favorite list.
+func (c *Client) hasGrantedSlot(p *Peer) bool {
+	key := hubNickPair{hub: p.Hub, nick: p.Nick}
+	if expiry, ok := c.grantedSlots[key]; ok {
+		if expiry.IsZero() || time.Now().Before(expiry) {
+			return true
+		}
+		delete(c.grantedSlots, key)
+	}
+
+	fav := c.FavoriteByPeer(p)
+	return fav != nil && fav.AutoGrant
+}
@@ -0,0 +1,240 @@
+package dctk
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+const (
+	hashCacheFileName  = "hashes.jsonl"
+	hashCacheLeavesDir = "leaves"
+)
+
+type hashCacheEntry struct {
+	Path    string
+	Size    uint64
+	ModTime int64
+	Inode   uint64
+	TTH     tiger.Hash
+}
+
+type hashCacheInodeKey struct {
+	inode   uint64
+	size    uint64
+	modTime int64
+}
+
+// hashCache is an on-disk store of the hashes of shared files, that allows
+// to avoid hashing them again when the client is restarted. Entries are
+// appended to a file while they are computed, and the file is compacted after
+// every indexing. TTH leaves are stored in separate files.
+type hashCache struct {
+	dir     string
+	entries map[string]*hashCacheEntry
+	byInode map[hashCacheInodeKey]*hashCacheEntry
+	used    map[string]*hashCacheEntry
+	file    *os.File
+}
+
+func newHashCache(dir string) (*hashCache, error) {
+	err := os.MkdirAll(filepath.Join(dir, hashCacheLeavesDir), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &hashCache{
+		dir:     dir,
+		entries: make(map[string]*hashCacheEntry),
+		byInode: make(map[hashCacheInodeKey]*hashCacheEntry),
+	}
+
+	err = hc.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return hc, nil
+}
+
+func (hc *hashCache) load() error {
+	f, err := os.Open(filepath.Join(hc.dir, hashCacheFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e hashCacheEntry
+		// skip corrupted lines, that can be produced by a crash
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		hc.add(&e)
+	}
+	return scanner.Err()
+}
+
+func (hc *hashCache) add(e *hashCacheEntry) {
+	hc.entries[e.Path] = e
+	if e.Inode != 0 {
+		hc.byInode[hashCacheInodeKey{e.Inode, e.Size, e.ModTime}] = e
+	}
+}
+
+func (hc *hashCache) leavesPath(tth tiger.Hash) string {
+	return filepath.Join(hc.dir, hashCacheLeavesDir, tth.String()+".tthl")
+}
+
+// begin is called before indexing.
+func (hc *hashCache) begin() error {
+	hc.used = make(map[string]*hashCacheEntry)
+
+	var err error
+	hc.file, err = os.OpenFile(filepath.Join(hc.dir, hashCacheFileName),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	return err
+}
+
+// get returns the TTH of a file, if the file was not modified since when it was hashed.
+// Files that were moved or renamed are found through their inode.
+func (hc *hashCache) get(path string, fi os.FileInfo) (tiger.Hash, bool) {
+	size := uint64(fi.Size())
+	modTime := fi.ModTime().UnixNano()
+	inode := fileInode(fi)
+
+	e, ok := hc.entries[path]
+	if !ok || e.Size != size || e.ModTime != modTime || e.Inode != inode {
+		if inode == 0 {
+			return tiger.Hash{}, false
+		}
+		e, ok = hc.byInode[hashCacheInodeKey{inode, size, modTime}]
+		if !ok {
+			return tiger.Hash{}, false
+		}
+	}
+
+	// leaves must be available too
+	if _, err := os.Stat(hc.leavesPath(e.TTH)); err != nil {
+		return tiger.Hash{}, false
+	}
+
+	if e.Path != path {
+		ne := *e
+		ne.Path = path
+		hc.append(&ne)
+		e = &ne
+	}
+
+	hc.used[path] = e
+	return e.TTH, true
+}
+
+// set saves the hashes of a file.
+func (hc *hashCache) set(path string, fi os.FileInfo, tthl tiger.Leaves) error {
+	tth := tthl.TreeHash()
+
+	err := tthl.SaveToFile(hc.leavesPath(tth))
+	if err != nil {
+		return err
+	}
+
+	e := &hashCacheEntry{
+		Path:    path,
+		Size:    uint64(fi.Size()),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   fileInode(fi),
+		TTH:     tth,
+	}
+	hc.append(e)
+	hc.used[path] = e
+	return nil
+}
+
+func (hc *hashCache) append(e *hashCacheEntry) {
+	hc.add(e)
+
+	byts, _ := json.Marshal(e)
+	byts = append(byts, '\n')
+	hc.file.Write(byts)
+}
+
+// flush is called after an incremental update of the share, and closes
+// the file without compacting it.
+func (hc *hashCache) flush() {
+	hc.file.Close()
+	hc.used = nil
+}
+
+// end is called after indexing, and removes the entries of files that
+// were deleted or modified. Entries of files that are not shared are kept,
+// since their directory may be shared again.
+func (hc *hashCache) end() error {
+	hc.file.Close()
+
+	for path, e := range hc.entries {
+		if _, ok := hc.used[path]; ok {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err == nil && uint64(fi.Size()) == e.Size && fi.ModTime().UnixNano() == e.ModTime {
+			hc.used[path] = e
+		}
+	}
+
+	fpath := filepath.Join(hc.dir, hashCacheFileName)
+	f, err := os.Create(fpath + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	usedTTHs := make(map[string]struct{})
+	for _, e := range hc.used {
+		byts, _ := json.Marshal(e)
+		w.Write(byts)
+		w.WriteByte('\n')
+		usedTTHs[e.TTH.String()] = struct{}{}
+	}
+
+	err = w.Flush()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(fpath+".tmp", fpath)
+	if err != nil {
+		return err
+	}
+
+	hc.entries = make(map[string]*hashCacheEntry)
+	hc.byInode = make(map[hashCacheInodeKey]*hashCacheEntry)
+	for _, e := range hc.used {
+		hc.add(e)
+	}
+	hc.used = nil
+
+	// remove unused leaves
+	files, err := os.ReadDir(filepath.Join(hc.dir, hashCacheLeavesDir))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".tthl")
+		if _, ok := usedTTHs[name]; !ok {
+			os.Remove(filepath.Join(hc.dir, hashCacheLeavesDir, file.Name()))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+package dctk
+
+import (
+	"os"
+)
+
+// inodes are not available on windows
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -3,11 +3,16 @@ package dctk
 import (
 	"crypto/tls"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/go-dc/adc"
+	atypes "github.com/aler9/go-dc/adc/types"
 	"github.com/aler9/go-dc/nmdc"
 	godctiger "github.com/aler9/go-dc/tiger"
 
@@ -30,6 +35,11 @@ const (
 	HubDescription HubField = ("description")
 )
 
+// the minimum duration of a session after which the redirect count is reset.
+// Shorter sessions do not reset it, in order to detect hubs that accept the
+// login and then redirect to each other.
+const hubRedirectResetPeriod = 1 * time.Minute
+
 type hubConnState int
 
 const (
@@ -75,6 +85,7 @@ type conn interface {
 	SetBinaryMode(val bool)
 	Read() (protocommon.MsgDecodable, error)
 	Write(msg protocommon.MsgEncodable)
+	WriteRaw(in []byte)
 	WriteSync(in []byte) error
 	PullReadCounter() uint
 	PullWriteCounter() uint
@@ -83,8 +94,24 @@ type conn interface {
 	DisableWriterZlib() error
 }
 
-type hubConn struct {
+type protocolName uint32
+
+const (
+	protocolNMDC protocolName = iota
+	protocolADC
+)
+
+// Hub represents a hub the client is connected to.
+type Hub struct {
 	client             *Client
+	url                string
+	nick               string
+	password           string
+	proto              protocolName // atomic
+	isEncrypted        bool
+	hostname           string
+	port               uint
+	solvedIP           string
 	name               string
 	terminateRequested bool
 	terminate          chan struct{}
@@ -92,30 +119,174 @@ type hubConn struct {
 	conn               conn
 	passwordSent       bool
 	uniqueCmds         map[string]struct{}
+	reconnectAttempt   uint
+	redirectCount      uint
+	initializedAt      time.Time
+	adcSessionID       atypes.SID
+	peers              map[string]*Peer
+	userCommands       []*UserCommand
+	searchQueue        []*searchQueueItem
+	searchLastSent     time.Time
+	searchTimer        *time.Timer
 }
 
-func newHubConn(client *Client) error {
-	client.hubConn = &hubConn{
+func parseHubURL(in string) (*url.URL, error) {
+	u, err := url.Parse(in)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse hub url")
+	}
+	if _, ok := map[string]struct{}{
+		"adc":   {},
+		"adcs":  {},
+		"dchub": {},
+		"nmdc":  {},
+		"nmdcs": {},
+	}[u.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported protocol: %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "adc":
+			u.Host = u.Hostname() + ":5000"
+
+		case "adcs":
+			u.Host = u.Hostname() + ":5001"
+
+		default:
+			u.Host = u.Hostname() + ":411"
+		}
+	}
+	return u, nil
+}
+
+func newHub(client *Client, hubURL string, nick string, password string) (*Hub, error) {
+	if nick == "" {
+		return nil, fmt.Errorf("nick is mandatory")
+	}
+
+	u, err := parseHubURL(hubURL)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hub{
 		client:     client,
+		nick:       nick,
+		password:   password,
 		terminate:  make(chan struct{}),
 		state:      hubDisconnected,
 		uniqueCmds: make(map[string]struct{}),
+		peers:      make(map[string]*Peer),
 	}
-	return nil
+	h.setURL(u)
+	return h, nil
 }
 
-// HubConnect starts the connection to the hub. It must be called only when
-// HubManualConnect is true.
+func (h *Hub) setURL(u *url.URL) {
+	h.url = u.String()
+	h.isEncrypted = u.Scheme == "adcs" || u.Scheme == "nmdcs"
+	h.hostname = u.Hostname()
+	h.port = atoui(u.Port())
+	if u.Scheme == "adc" || u.Scheme == "adcs" {
+		h.setProto(protocolADC)
+	} else {
+		h.setProto(protocolNMDC)
+	}
+}
+
+// HubAdd adds a hub to the client, in the format protocol://address:port.
+// If nick is empty, the one in ClientConf is used. The connection is started
+// immediately, unless HubManualConnect is true.
+func (c *Client) HubAdd(hubURL string, nick string, password string) (*Hub, error) {
+	if nick == "" {
+		nick = c.conf.Nick
+	}
+
+	h, err := newHub(c, hubURL, nick, password)
+	if err != nil {
+		return nil, err
+	}
+	c.hubs = append(c.hubs, h)
+
+	if c.started && !c.conf.HubManualConnect {
+		h.Connect()
+	}
+	return h, nil
+}
+
+// HubDel disconnects the client from a hub and removes it. Downloads that
+// are waiting for the hub fail.
+func (c *Client) HubDel(h *Hub) {
+	for i, oh := range c.hubs {
+		if oh == h {
+			c.hubs = append(c.hubs[:i], c.hubs[i+1:]...)
+			h.close()
+
+			for t := range c.transfers {
+				if d, ok := t.(*Download); ok {
+					if !d.terminateRequested && d.state == "waiting_hub" && d.conf.Peer.Hub == h {
+						d.state = "waited_hub"
+						d.hubChan <- fmt.Errorf("hub was removed")
+					}
+				}
+			}
+			return
+		}
+	}
+}
+
+// Hubs returns all the hubs added to the client.
+func (c *Client) Hubs() []*Hub {
+	return c.hubs
+}
+
+// HubConnect starts the connection to every hub that is not connected yet.
+// It must be called only when HubManualConnect is true.
 func (c *Client) HubConnect() {
-	if c.hubConn.state != hubDisconnected {
+	for _, h := range c.hubs {
+		h.Connect()
+	}
+}
+
+// Connect starts the connection to the hub. It must be called only when
+// HubManualConnect is true.
+func (h *Hub) Connect() {
+	if h.terminateRequested || h.state != hubDisconnected {
 		return
 	}
-	c.hubConn.state = hubConnecting
-	c.wg.Add(1)
-	go c.hubConn.do()
+	h.state = hubConnecting
+	h.client.wg.Add(1)
+	go h.do()
+}
+
+// URL returns the hub url.
+func (h *Hub) URL() string {
+	return h.url
+}
+
+// Name returns the hub name, if provided by the hub.
+func (h *Hub) Name() string {
+	return h.name
 }
 
-func (h *hubConn) close() {
+// Nick returns the nickname used in the hub.
+func (h *Hub) Nick() string {
+	return h.nick
+}
+
+func (h *Hub) getProto() protocolName {
+	return protocolName(atomic.LoadUint32((*uint32)(&h.proto)))
+}
+
+func (h *Hub) setProto(p protocolName) {
+	atomic.StoreUint32((*uint32)(&h.proto), uint32(p))
+}
+
+func (h *Hub) protoIsAdc() bool {
+	return h.getProto() == protocolADC
+}
+
+func (h *Hub) close() {
 	if h.terminateRequested {
 		return
 	}
@@ -123,149 +294,298 @@ func (h *hubConn) close() {
 	close(h.terminate)
 }
 
-func (h *hubConn) do() {
+func (h *Hub) do() {
 	defer h.client.wg.Done()
 
-	err := func() error {
-		// resolve hub ip
-		ips, err := net.LookupIP(h.client.hubHostname)
-		if err != nil {
-			return err
-		}
-		h.client.hubSolvedIP = ips[0].String()
+	for {
+		err := h.connect()
 
-		// connect to hub
-		ce := newConnEstablisher(
-			fmt.Sprintf("%s:%d", h.client.hubSolvedIP, h.client.hubPort),
-			10*time.Second, h.client.conf.HubConnTries)
+		var delay time.Duration
+		reconnect := false
+		h.client.Safe(func() {
+			redirected := false
+			if rerr, ok := err.(hubRedirectError); ok && !h.terminateRequested {
+				redirected = h.handleRedirect(rerr.url)
+			}
 
-		select {
-		case <-h.terminate:
-			return protocommon.ErrorTerminated
-		case <-ce.Wait:
-		}
+			if !h.terminateRequested && !redirected {
+				log.Log(h.client.conf.LogLevel, log.LevelInfo, "ERR: %s", err)
 
-		if ce.Error != nil {
-			return ce.Error
-		}
+				if h.client.OnHubError != nil {
+					h.client.OnHubError(h, err)
+				}
+			}
 
-		// hub connected
-		rawconn := ce.Conn
-		if h.client.hubIsEncrypted {
-			tlsconn := tls.Client(rawconn, &tls.Config{
-				InsecureSkipVerify: true,
-				NextProtos:         []string{"adc", "nmdc"},
-			})
-			rawconn = tlsconn
-			err = tlsconn.Handshake()
-			if err != nil {
-				tlsconn.Close()
-				return err
+			log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] disconnected")
+
+			h.handleDisconnected()
+
+			if !h.terminateRequested && h.client.OnHubDisconnected != nil {
+				h.client.OnHubDisconnected(h, err)
 			}
-			st := tlsconn.ConnectionState()
-			if h.client.OnHubTLS != nil {
-				h.client.OnHubTLS(st)
+
+			if h.terminateRequested {
+				return
+			}
+
+			// connect immediately to the new address
+			if redirected {
+				reconnect = true
+				return
 			}
-			if st.NegotiatedProtocol != "" {
-				log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] negotiated %q", st.NegotiatedProtocol)
-				// ALPN negotiation
-				switch st.NegotiatedProtocol {
-				case "adc":
-					h.client.setProto(protocolADC)
-				case "nmdc":
-					h.client.setProto(protocolNMDC)
+
+			if !h.client.conf.HubReconnect ||
+				(h.client.conf.HubReconnectMaxTries != 0 &&
+					h.reconnectAttempt >= h.client.conf.HubReconnectMaxTries) {
+				h.client.HubDel(h)
+
+				// close client too if there are no hubs left
+				if len(h.client.hubs) == 0 {
+					h.client.Close()
 				}
+				return
 			}
-		}
 
-		// do not use read timeout since hub does not send data continuously
-		var protoName string
-		if h.client.protoIsAdc() {
-			protoName = "adc"
-			h.conn = protoadc.NewConn(h.client.conf.LogLevel, "h", rawconn, false, true)
-		} else {
-			protoName = "nmdc"
-			h.conn = protonmdc.NewConn(h.client.conf.LogLevel, "h", rawconn, false, true)
-		}
-		if h.client.OnHubProto != nil {
-			h.client.OnHubProto(protoName)
+			h.reconnectAttempt++
+			delay = h.reconnectDelay()
+			reconnect = true
+
+			log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] reconnecting in %v (attempt %d)",
+				delay, h.reconnectAttempt)
+
+			if h.client.OnHubReconnecting != nil {
+				h.client.OnHubReconnecting(h, h.reconnectAttempt, delay)
+			}
+		})
+		if !reconnect {
+			return
 		}
 
-		if !h.client.conf.HubDisableKeepAlive {
-			keepaliver := newHubKeepAliver(h)
-			defer keepaliver.Close()
+		select {
+		case <-time.After(delay):
+		case <-h.terminate:
+			return
 		}
+	}
+}
 
-		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] connected (%s)", rawconn.RemoteAddr())
+func (h *Hub) connect() error {
+	// resolve hub ip
+	ips, err := net.LookupIP(h.hostname)
+	if err != nil {
+		return err
+	}
+	solvedIP := ips[0].String()
+	h.client.Safe(func() {
+		h.solvedIP = solvedIP
+	})
 
-		if h.client.protoIsAdc() {
-			features := adc.ModFeatures{
-				adc.FeaBAS0: true,
-				adc.FeaBASE: true,
-				adc.FeaTIGR: true,
-				adc.FeaUCM0: true,
-			}
-			if !h.client.conf.HubDisableCompression {
-				features[adc.FeaZLIF] = true
+	// connect to hub
+	ce := newConnEstablisher(
+		fmt.Sprintf("%s:%d", solvedIP, h.port),
+		10*time.Second, h.client.conf.HubConnTries)
+
+	select {
+	case <-h.terminate:
+		return protocommon.ErrorTerminated
+	case <-ce.Wait:
+	}
+
+	if ce.Error != nil {
+		return ce.Error
+	}
+
+	// hub connected
+	rawconn := ce.Conn
+	if h.isEncrypted {
+		tlsconn := tls.Client(rawconn, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"adc", "nmdc"},
+		})
+		rawconn = tlsconn
+		err = tlsconn.Handshake()
+		if err != nil {
+			tlsconn.Close()
+			return err
+		}
+		st := tlsconn.ConnectionState()
+		if h.client.OnHubTLS != nil {
+			h.client.OnHubTLS(h, st)
+		}
+		if st.NegotiatedProtocol != "" {
+			log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] negotiated %q", st.NegotiatedProtocol)
+			// ALPN negotiation
+			switch st.NegotiatedProtocol {
+			case "adc":
+				h.setProto(protocolADC)
+			case "nmdc":
+				h.setProto(protocolNMDC)
 			}
-			h.conn.Write(&protoadc.AdcHSupports{ //nolint:govet
-				&adc.HubPacket{},
-				&adc.Supported{features}, //nolint:govet
-			})
 		}
+	}
 
-		h.client.Safe(func() {
-			h.state = hubConnected
-		})
+	// do not use read timeout since hub does not send data continuously
+	var protoName string
+	var hconn conn
+	if h.protoIsAdc() {
+		protoName = "adc"
+		hconn = protoadc.NewConn(h.client.conf.LogLevel, "h", rawconn, false, true)
+	} else {
+		protoName = "nmdc"
+		hconn = protonmdc.NewConn(h.client.conf.LogLevel, "h", rawconn, false, true)
+	}
 
-		readDone := make(chan error)
-		go func() {
-			readDone <- func() error {
-				for {
-					msg, err := h.conn.Read()
-					if err != nil {
-						return err
-					}
+	// the connection is accessed by other routines through Safe()
+	h.client.Safe(func() {
+		h.conn = hconn
+	})
+	if h.client.OnHubProto != nil {
+		h.client.OnHubProto(h, protoName)
+	}
 
-					h.client.Safe(func() {
-						err = h.handleMessage(msg)
-					})
-					if err != nil {
-						return err
-					}
-				}
-			}()
-		}()
+	if !h.client.conf.HubDisableKeepAlive {
+		keepaliver := newHubKeepAliver(h)
+		defer keepaliver.Close()
+	}
 
-		select {
-		case <-h.terminate:
-			h.conn.Close()
-			<-readDone
-			return protocommon.ErrorTerminated
+	log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] connected (%s)", rawconn.RemoteAddr())
 
-		case err := <-readDone:
-			h.conn.Close()
-			return err
+	if h.protoIsAdc() {
+		features := adc.ModFeatures{
+			adc.FeaBAS0: true,
+			adc.FeaBASE: true,
+			adc.FeaTIGR: true,
+			adc.FeaUCM0: true,
 		}
-	}()
+		if !h.client.conf.HubDisableCompression {
+			features[adc.FeaZLIF] = true
+		}
+		hconn.Write(&protoadc.AdcHSupports{ //nolint:govet
+			&adc.HubPacket{},
+			&adc.Supported{features}, //nolint:govet
+		})
+	}
 
 	h.client.Safe(func() {
-		if !h.terminateRequested {
-			log.Log(h.client.conf.LogLevel, log.LevelInfo, "ERR: %s", err)
+		h.state = hubConnected
+	})
+
+	readDone := make(chan error)
+	go func() {
+		readDone <- func() error {
+			for {
+				msg, err := hconn.Read()
+				if err != nil {
+					return err
+				}
 
-			if h.client.OnHubError != nil {
-				h.client.OnHubError(err)
+				h.client.Safe(func() {
+					err = h.handleMessage(msg)
+				})
+				if err != nil {
+					return err
+				}
 			}
+		}()
+	}()
+
+	select {
+	case <-h.terminate:
+		hconn.Close()
+		<-readDone
+		return protocommon.ErrorTerminated
+
+	case err := <-readDone:
+		hconn.Close()
+		return err
+	}
+}
+
+// handleDisconnected resets the hub state, in order to allow a new connection.
+func (h *Hub) handleDisconnected() {
+	h.state = hubConnecting
+	h.passwordSent = false
+	h.initializedAt = time.Time{}
+	h.uniqueCmds = make(map[string]struct{})
+	h.userCommands = nil
+	h.searchQueueClear()
+
+	// peers are sent again by the hub after a reconnection
+	if !h.client.terminateRequested {
+		for _, p := range h.peers {
+			h.client.handlePeerDisconnected(p)
 		}
+	}
+}
 
-		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] disconnected")
+// hubRedirectError is returned when a hub redirects the client to another address.
+type hubRedirectError struct {
+	url string
+	msg string
+}
 
-		// close client too
-		h.client.Close()
-	})
+func (e hubRedirectError) Error() string {
+	return e.msg
 }
 
-func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
+// handleRedirect decides whether to follow a redirect, and in that case
+// replaces the hub address.
+func (h *Hub) handleRedirect(rawURL string) bool {
+	if !h.client.conf.FollowRedirects {
+		return false
+	}
+
+	if !h.initializedAt.IsZero() && time.Since(h.initializedAt) >= hubRedirectResetPeriod {
+		h.redirectCount = 0
+	}
+
+	if h.redirectCount >= h.client.conf.RedirectLimit {
+		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] redirect limit reached")
+		return false
+	}
+
+	// addresses without a protocol use the one of the current hub
+	if !strings.Contains(rawURL, "://") {
+		cur, _ := url.Parse(h.url)
+		rawURL = cur.Scheme + "://" + rawURL
+	}
+
+	u, err := parseHubURL(rawURL)
+	if err != nil {
+		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] invalid redirect: %s", err)
+		return false
+	}
+
+	if h.client.OnHubRedirect != nil && !h.client.OnHubRedirect(h, u.String()) {
+		return false
+	}
+
+	log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] redirected to %s", u.String())
+
+	h.redirectCount++
+	h.setURL(u)
+	return true
+}
+
+// reconnectDelay computes the delay before the next reconnection attempt,
+// with exponential backoff and jitter.
+func (h *Hub) reconnectDelay() time.Duration {
+	delay := h.client.conf.HubReconnectMinDelay
+	for i := uint(1); i < h.reconnectAttempt && delay < h.client.conf.HubReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > h.client.conf.HubReconnectMaxDelay {
+		delay = h.client.conf.HubReconnectMaxDelay
+	}
+
+	if h.client.conf.HubReconnectJitter > 0 {
+		delta := float64(delay) * h.client.conf.HubReconnectJitter
+		delay += time.Duration((rand.Float64()*2 - 1) * delta)
+	}
+	return delay
+}
+
+func (h *Hub) handleMessage(msgi protocommon.MsgDecodable) error {
 	switch msg := msgi.(type) {
 	case *protoadc.AdcKeepAlive:
 
@@ -299,13 +619,13 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[SessionId] invalid state: %s", h.state)
 		}
 		h.state = hubSessionID
-		h.client.adcSessionID = msg.Msg.SID
-		h.client.sendInfos(true)
+		h.adcSessionID = msg.Msg.SID
+		h.sendInfos(true)
 
 	case *protoadc.AdcIInfos:
 		onHubInfo := func(k HubField, v string) {
 			if h.client.OnHubInfo != nil {
-				h.client.OnHubInfo(k, v)
+				h.client.OnHubInfo(h, k, v)
 			}
 			log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] [%s] %s", k, v)
 		}
@@ -325,7 +645,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 	case *protoadc.AdcIMsg:
-		h.client.handlePublicMessage(&Peer{Nick: h.name}, msg.Msg.Text)
+		h.client.handlePublicMessage(&Peer{Nick: h.name, Hub: h}, msg.Msg.Text)
 		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] %s", msg.Msg.Text)
 
 	case *protoadc.AdcIGetPass:
@@ -335,7 +655,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		h.state = hubGetPass
 
 		hasher := tiger.NewHash()
-		hasher.Write([]byte(h.client.conf.Password))
+		hasher.Write([]byte(h.password))
 		hasher.Write(msg.Msg.Salt)
 		var data godctiger.Hash
 		hasher.Sum(data[:0])
@@ -348,7 +668,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 	case *protoadc.AdcBInfos:
 		exists := true
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			exists = false
 
@@ -356,12 +676,13 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			if msg.Msg.Name == "" {
 				return fmt.Errorf("peer name not provided")
 			}
-			if h.client.peerByNick(msg.Msg.Name) != nil {
+			if h.peerByNick(msg.Msg.Name) != nil {
 				return fmt.Errorf("a peer with this name already exists")
 			}
 
 			p = &Peer{
 				Nick:         msg.Msg.Name,
+				Hub:          h,
 				adcSessionID: msg.Pkt.ID,
 			}
 		}
@@ -417,11 +738,17 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 	case *protoadc.AdcIQuit:
 		// self quit, used instead of ForceMove
-		if msg.Msg.ID == h.client.adcSessionID {
+		if msg.Msg.ID == h.adcSessionID {
+			if msg.Msg.Redirect != "" {
+				return hubRedirectError{
+					url: msg.Msg.Redirect,
+					msg: fmt.Sprintf("received Quit message with redirect to %s: %s", msg.Msg.Redirect, msg.Msg.Message),
+				}
+			}
 			return fmt.Errorf("received Quit message: %s", msg.Msg.Message)
 		}
 		// peer quit
-		p := h.client.peerBySessionID(msg.Msg.ID)
+		p := h.peerBySessionID(msg.Msg.ID)
 		if p != nil {
 			h.client.handlePeerDisconnected(p)
 		}
@@ -432,23 +759,24 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			h.state = hubInitialized
 			h.handleHubInitialized()
 		}
+		h.handleAdcUserCommand(msg.Msg)
 
 	case *protoadc.AdcBMessage:
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			return fmt.Errorf("public message with unknown author")
 		}
 		h.client.handlePublicMessage(p, msg.Msg.Text)
 
 	case *protoadc.AdcDMessage:
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			return fmt.Errorf("private message with unknown author")
 		}
 		h.client.handlePrivateMessage(p, msg.Msg.Text)
 
 	case *protoadc.AdcBSearchRequest:
-		h.client.handleAdcSearchIncomingRequest(msg.Pkt.ID, msg.Msg)
+		h.handleAdcSearchIncomingRequest(msg.Pkt.ID, msg.Msg)
 
 	case *protoadc.AdcFSearchRequest:
 		hasFeature := func(f adc.Feature) bool {
@@ -465,17 +793,17 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return nil
 		}
 
-		h.client.handleAdcSearchIncomingRequest(msg.Pkt.ID, msg.Msg)
+		h.handleAdcSearchIncomingRequest(msg.Pkt.ID, msg.Msg)
 
 	case *protoadc.AdcDSearchResult:
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			return fmt.Errorf("search result with unknown author")
 		}
 		h.client.handleAdcSearchResult(false, p, msg.Msg)
 
 	case *protoadc.AdcDConnectToMe:
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			return fmt.Errorf("connecttome with unknown author")
 		}
@@ -489,7 +817,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			adc.ProtoADCS: {},
 		}[msg.Msg.Proto]; !ok {
 			h.conn.Write(&protoadc.AdcDStatus{ //nolint:govet
-				&adc.DirectPacket{ID: h.client.adcSessionID, To: msg.Pkt.ID},
+				&adc.DirectPacket{ID: h.adcSessionID, To: msg.Pkt.ID},
 				&adc.Status{
 					Sev:  adc.Recoverable,
 					Code: protoadc.AdcCodeProtocolUnsupported,
@@ -511,7 +839,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			(msg.Msg.Proto == adc.ProtoADC &&
 				h.client.conf.PeerEncryptionMode == ForceEncryption) {
 			h.conn.Write(&protoadc.AdcDStatus{ //nolint:govet
-				&adc.DirectPacket{ID: h.client.adcSessionID, To: msg.Pkt.ID},
+				&adc.DirectPacket{ID: h.adcSessionID, To: msg.Pkt.ID},
 				&adc.Status{
 					Sev:  adc.Recoverable,
 					Code: protoadc.AdcCodeProtocolUnsupported,
@@ -526,10 +854,10 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return nil
 		}
 
-		newPeerConn(h.client, (msg.Msg.Proto == adc.ProtoADCS), false, nil, p.IP, uint(msg.Msg.Port), msg.Msg.Token)
+		newPeerConn(h.client, h, (msg.Msg.Proto == adc.ProtoADCS), false, nil, p.IP, uint(msg.Msg.Port), msg.Msg.Token)
 
 	case *protoadc.AdcDRevConnectToMe:
-		p := h.client.peerBySessionID(msg.Pkt.ID)
+		p := h.peerBySessionID(msg.Pkt.ID)
 		if p == nil {
 			return fmt.Errorf("revconnecttome with unknown author")
 		}
@@ -573,7 +901,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 		h.conn.Write(&nmdc.Supports{features}) //nolint:govet
 		h.conn.Write(msg.Key())
-		h.conn.Write(&nmdc.ValidateNick{Name: nmdc.Name(h.client.conf.Nick)})
+		h.conn.Write(&nmdc.ValidateNick{Name: nmdc.Name(h.nick)})
 
 	case *nmdc.ValidateDenide:
 		return fmt.Errorf("forbidden nickname")
@@ -591,7 +919,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[HubName] invalid state: %s", h.state)
 		}
 		if h.client.OnHubInfo != nil {
-			h.client.OnHubInfo(HubName, string(msg.String))
+			h.client.OnHubInfo(h, HubName, string(msg.String))
 		}
 		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] [name] %s", string(msg.String))
 
@@ -600,7 +928,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[HubTopic] invalid state: %s", h.state)
 		}
 		if h.client.OnHubInfo != nil {
-			h.client.OnHubInfo(HubTopic, msg.Text)
+			h.client.OnHubInfo(h, HubTopic, msg.Text)
 		}
 		log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] [topic] %s", msg.Text)
 
@@ -609,7 +937,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[GetPass] invalid state: %s", h.state)
 		}
 		h.passwordSent = true
-		h.conn.Write(&nmdc.MyPass{nmdc.String(h.client.conf.Password)}) //nolint:govet
+		h.conn.Write(&nmdc.MyPass{nmdc.String(h.password)}) //nolint:govet
 		if _, ok := h.uniqueCmds["GetPass"]; ok {
 			return fmt.Errorf("GetPass sent twice")
 		}
@@ -642,7 +970,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		// The last version of the Neo-Modus client was 1,0091 and is what is commonly used by current clients
 		// https://github.com/eiskaltdcpp/eiskaltdcpp/blob/1e72256ac5e8fe6735f81bfbc3f9d90514ada578/dcpp/NmdcHub.h#L119
 		h.conn.Write(&nmdc.Version{Vers: "1,0091"})
-		h.client.sendInfos(true)
+		h.sendInfos(true)
 		h.conn.Write(&nmdc.GetNickList{})
 
 	case *nmdc.MyINFO:
@@ -650,10 +978,10 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[MyInfo] invalid state: %s", h.state)
 		}
 		exists := true
-		p := h.client.peerByNick(msg.Name)
+		p := h.peerByNick(msg.Name)
 		if p == nil {
 			exists = false
-			p = &Peer{Nick: msg.Name}
+			p = &Peer{Nick: msg.Name, Hub: h}
 		}
 
 		p.Description = msg.Desc
@@ -683,7 +1011,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		// ips of other peers
 		for _, entry := range msg.List {
 			// update peer
-			if p := h.client.peerByNick(entry.Name); p != nil {
+			if p := h.peerByNick(entry.Name); p != nil {
 				p.IP = entry.IP
 				h.client.handlePeerUpdated(p)
 			}
@@ -695,7 +1023,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		updatedPeers := make(map[string]struct{})
-		for _, p := range h.client.peers {
+		for _, p := range h.peers {
 			if p.IsOperator {
 				updatedPeers[p.Nick] = struct{}{}
 				p.IsOperator = false
@@ -703,7 +1031,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		for _, name := range msg.Names {
-			h.client.peers[name].IsOperator = true
+			h.peers[name].IsOperator = true
 			if _, ok := updatedPeers[name]; ok {
 				delete(updatedPeers, name)
 			} else {
@@ -712,7 +1040,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		for name := range updatedPeers {
-			h.client.handlePeerUpdated(h.client.peers[name])
+			h.client.handlePeerUpdated(h.peers[name])
 		}
 
 		// switch to initialized
@@ -727,7 +1055,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		updatedPeers := make(map[string]struct{})
-		for _, p := range h.client.peers {
+		for _, p := range h.peers {
 			if p.IsBot {
 				updatedPeers[p.Nick] = struct{}{}
 				p.IsBot = false
@@ -735,7 +1063,7 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		for _, name := range msg.Names {
-			h.client.peers[name].IsBot = true
+			h.peers[name].IsBot = true
 			if _, ok := updatedPeers[name]; ok {
 				delete(updatedPeers, name)
 			} else {
@@ -744,39 +1072,42 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		for name := range updatedPeers {
-			h.client.handlePeerUpdated(h.client.peers[name])
+			h.client.handlePeerUpdated(h.peers[name])
 		}
 
 	case *nmdc.UserCommand:
 		if h.state != hubPreInitialized && h.state != hubInitialized {
 			return fmt.Errorf("[UserCommand] invalid state: %s", h.state)
 		}
+		h.handleNmdcUserCommand(msg)
 
 	case *nmdc.Quit:
 		if h.state != hubInitialized {
 			return fmt.Errorf("[Quit] invalid state: %s", h.state)
 		}
-		p := h.client.peerByNick(string(msg.Name))
+		p := h.peerByNick(string(msg.Name))
 		if p != nil {
 			h.client.handlePeerDisconnected(p)
 		}
 
 	case *nmdc.ForceMove:
 		// means disconnect and reconnect to provided address
-		// we just disconnect
-		return fmt.Errorf("received force move (%+v)", msg)
+		return hubRedirectError{
+			url: msg.Address,
+			msg: fmt.Sprintf("received force move (%+v)", msg),
+		}
 
 	case *nmdc.Search:
 		// searches can be received even before initialization; ignore them
 		if h.state == hubInitialized {
-			h.client.handleNmdcSearchIncomingRequest(msg)
+			h.handleNmdcSearchIncomingRequest(msg)
 		}
 
 	case *nmdc.SR:
 		if h.state != hubInitialized {
 			return fmt.Errorf("[SearchResult] invalid state: %s", h.state)
 		}
-		h.client.handleNmdcSearchResult(false, msg)
+		h.handleNmdcSearchResult(false, msg)
 
 	case *nmdc.ConnectToMe:
 		matches := protonmdc.ReNmdcAddress.FindStringSubmatch(msg.Address)
@@ -799,29 +1130,29 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 				"received plain connect to me request but encryption is forced, skipping")
 
 		default:
-			newPeerConn(h.client, msg.Secure, false, nil, ip, port, "")
+			newPeerConn(h.client, h, msg.Secure, false, nil, ip, port, "")
 		}
 
 	case *nmdc.RevConnectToMe:
 		if h.state != hubInitialized && h.state != hubPreInitialized {
 			return fmt.Errorf("[RevConnectToMe] invalid state: %s", h.state)
 		}
-		p := h.client.peerByNick(msg.From)
+		p := h.peerByNick(msg.From)
 		if p != nil {
 			h.client.handlePeerRevConnectToMe(p, "")
 		}
 
 	case *nmdc.ChatMessage:
-		p := h.client.peerByNick(msg.Name)
+		p := h.peerByNick(msg.Name)
 		if p == nil { // create a dummy peer if not found
-			p = &Peer{Nick: msg.Name}
+			p = &Peer{Nick: msg.Name, Hub: h}
 		}
 		h.client.handlePublicMessage(p, msg.Text)
 
 	case *nmdc.PrivateMessage:
-		p := h.client.peerByNick(msg.From)
+		p := h.peerByNick(msg.From)
 		if p == nil { // create a dummy peer if not found
-			p = &Peer{Nick: msg.From}
+			p = &Peer{Nick: msg.From, Hub: h}
 		}
 		h.client.handlePrivateMessage(p, msg.Text)
 
@@ -831,9 +1162,22 @@ func (h *hubConn) handleMessage(msgi protocommon.MsgDecodable) error {
 	return nil
 }
 
-func (h *hubConn) handleHubInitialized() {
-	log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] initialized, %d peers", len(h.client.peers))
+func (h *Hub) handleHubInitialized() {
+	log.Log(h.client.conf.LogLevel, log.LevelInfo, "[hub] initialized, %d peers", len(h.peers))
+	h.reconnectAttempt = 0
+	h.initializedAt = time.Now()
+
+	// resume downloads that were waiting for the hub
+	for t := range h.client.transfers {
+		if d, ok := t.(*Download); ok {
+			if !d.terminateRequested && d.state == "waiting_hub" && d.conf.Peer.Hub == h {
+				d.state = "waited_hub"
+				d.hubChan <- nil
+			}
+		}
+	}
+
 	if h.client.OnHubConnected != nil {
-		h.client.OnHubConnected()
+		h.client.OnHubConnected(h)
 	}
 }
@@ -16,7 +16,7 @@ type hubKeepAliver struct {
 	done      chan struct{}
 }
 
-func newHubKeepAliver(h *hubConn) *hubKeepAliver {
+func newHubKeepAliver(h *Hub) *hubKeepAliver {
 	ka := &hubKeepAliver{
 		terminate: make(chan struct{}),
 		done:      make(chan struct{}),
@@ -32,7 +32,7 @@ func newHubKeepAliver(h *hubConn) *hubKeepAliver {
 			case <-ticker.C:
 				// we must call Safe() since conn.Write() is not thread safe
 				h.client.Safe(func() {
-					if h.client.protoIsAdc() {
+					if h.protoIsAdc() {
 						// ADC uses the TCP keepalive feature or empty packets
 						h.conn.Write(&protoadc.AdcKeepAlive{})
 					} else {
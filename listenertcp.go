@@ -42,13 +42,12 @@ func newListenerTCP(client *Client, isEncrypted bool) error {
 			return err
 		}
 
-		if client.protoIsAdc() {
-			xcert, err := x509.ParseCertificate(bcert)
-			if err != nil {
-				return err
-			}
-			client.adcFingerprint = protoadc.AdcCertFingerprint(xcert)
+		// the fingerprint is used by ADC hubs only
+		xcert, err := x509.ParseCertificate(bcert)
+		if err != nil {
+			return err
 		}
+		client.adcFingerprint = protoadc.AdcCertFingerprint(xcert)
 
 		certPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bcert})
 		keyPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
@@ -103,7 +102,7 @@ func (t *listenerTCP) do() {
 		}
 
 		t.client.Safe(func() {
-			newPeerConn(t.client, t.isEncrypted, true, rawconn, "", 0, "")
+			newPeerConn(t.client, nil, t.isEncrypted, true, rawconn, "", 0, "")
 		})
 	}
 }
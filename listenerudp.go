@@ -3,6 +3,7 @@ package dctk
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/aler9/go-dc/adc"
 	"github.com/aler9/go-dc/nmdc"
@@ -54,16 +55,14 @@ func (u *listenerUDP) do() {
 
 		u.client.Safe(func() {
 			err := func() error {
-				if u.client.protoIsAdc() {
+				// the protocol is detected from the message, since results
+				// can be sent by peers of any hub
+				if strings.HasPrefix(msgStr, "URES ") {
 					if msgStr[len(msgStr)-1] != '\n' {
 						return fmt.Errorf("wrong terminator")
 					}
 					msgStr = msgStr[:len(msgStr)-1]
 
-					if msgStr[:5] != "URES " {
-						return fmt.Errorf("wrong command")
-					}
-
 					pkt, err := adc.DecodePacket([]byte(msgStr + "\n"))
 					if err != nil {
 						return err
@@ -107,7 +106,23 @@ func (u *listenerUDP) do() {
 					return fmt.Errorf("wrong search result")
 				}
 
-				u.client.handleNmdcSearchResult(true, msg)
+				// find the hub through its address, or through the author
+				var hub *Hub
+				for _, h := range u.client.hubs {
+					if !h.protoIsAdc() && fmt.Sprintf("%s:%d", h.solvedIP, h.port) == msg.HubAddress {
+						hub = h
+						break
+					}
+				}
+				if hub == nil {
+					p := u.client.peerByNick(protocolNMDC, msg.From)
+					if p == nil {
+						return fmt.Errorf("unknown author")
+					}
+					hub = p.Hub
+				}
+
+				hub.handleNmdcSearchResult(true, msg)
 				return nil
 			}()
 			if err != nil {
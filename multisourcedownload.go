@@ -0,0 +1,532 @@
+package dctk
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+const (
+	// a source can be considered slow only after this period
+	multiSourceSlowPeriod = 10 * time.Second
+	// a source is discarded after this number of failed segments
+	multiSourceMaxFailures = 3
+)
+
+// MultiSourceDownloadConf allows to configure a multi-source download.
+type MultiSourceDownloadConf struct {
+	// the peers that own the file. Other peers can be added later with AddSource()
+	Peers []*Peer
+	// the TTH of the file to download
+	TTH tiger.Hash
+	// the size of the file
+	Size uint64
+	// the path on disk where the file is saved
+	SavePath string
+	// the size of segments. It defaults to 1MiB and is rounded up to a
+	// multiple of the part of file covered by a TTH leaf
+	SegmentSize uint64
+	// a segment is assigned to another source if it is being downloaded below
+	// this speed, in bytes/sec. It defaults to 10KiB/s
+	MinSegmentSpeed uint64
+}
+
+type multiSourceSource struct {
+	peer       *Peer
+	seg        *multiSourceSegment
+	received   uint64
+	failures   uint
+	slow       bool
+	tthlFailed bool
+}
+
+type multiSourceSegment struct {
+	start           uint64
+	length          uint64
+	done            bool
+	verifying       bool
+	dl              *Download
+	processingSince time.Time
+}
+
+// MultiSourceDownload represents an in-progress file download from multiple
+// peers at once. The file is split into segments, that are downloaded in
+// parallel and verified through the TTH leaves.
+type MultiSourceDownload struct {
+	conf               MultiSourceDownloadConf
+	client             *Client
+	terminateRequested bool
+	terminate          chan struct{}
+	sources            []*multiSourceSource
+	segments           []*multiSourceSegment
+	leaves             tiger.Leaves
+	blockSize          uint64
+	leavesDl           *Download
+	file               *os.File
+}
+
+// MultiSourceDownload starts downloading a file by its Tiger Tree Hash (TTH)
+// from multiple peers. See MultiSourceDownloadConf for the options.
+func (c *Client) MultiSourceDownload(conf MultiSourceDownloadConf) (*MultiSourceDownload, error) {
+	if len(conf.Peers) == 0 {
+		return nil, fmt.Errorf("at least one peer is required")
+	}
+	if conf.Size == 0 {
+		return nil, fmt.Errorf("size is mandatory")
+	}
+	if conf.SavePath == "" {
+		return nil, fmt.Errorf("save path is mandatory")
+	}
+	if conf.SegmentSize == 0 {
+		conf.SegmentSize = 1024 * 1024
+	}
+	if conf.MinSegmentSpeed == 0 {
+		conf.MinSegmentSpeed = 10 * 1024
+	}
+
+	f, err := os.Create(conf.SavePath + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create destination file")
+	}
+	err = f.Truncate(int64(conf.Size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := &MultiSourceDownload{
+		conf:      conf,
+		client:    c,
+		terminate: make(chan struct{}),
+		file:      f,
+	}
+	for _, p := range conf.Peers {
+		d.sources = append(d.sources, &multiSourceSource{peer: p})
+	}
+	c.multiSourceDownloads[d] = struct{}{}
+
+	log.Log(c.conf.LogLevel, log.LevelInfo, "[download] requesting %s from %d sources (size=%d)",
+		conf.TTH, len(d.sources), conf.Size)
+
+	// the download is started by its routine, in order to call callbacks
+	// after this function has returned
+	c.wg.Add(1)
+	go d.do()
+
+	return d, nil
+}
+
+// Conf returns the configuration passed at download initialization.
+func (d *MultiSourceDownload) Conf() MultiSourceDownloadConf {
+	return d.conf
+}
+
+// AddSource adds a peer to the sources of the download.
+func (d *MultiSourceDownload) AddSource(p *Peer) {
+	for _, src := range d.sources {
+		if src.peer.Hub == p.Hub && src.peer.Nick == p.Nick {
+			return
+		}
+	}
+	d.sources = append(d.sources, &multiSourceSource{peer: p})
+	d.start()
+}
+
+// Received returns the amount of verified bytes.
+func (d *MultiSourceDownload) Received() uint64 {
+	var ret uint64
+	for _, seg := range d.segments {
+		if seg.done {
+			ret += seg.length
+		}
+	}
+	return ret
+}
+
+// Close stops the download. OnMultiSourceDownloadError and
+// OnMultiSourceDownloadSuccessful are not called.
+func (d *MultiSourceDownload) Close() {
+	if d.terminateRequested {
+		return
+	}
+	d.terminateRequested = true
+	d.cleanup()
+}
+
+func (d *MultiSourceDownload) cleanup() {
+	close(d.terminate)
+	if d.leavesDl != nil {
+		d.leavesDl.Close()
+	}
+	for _, seg := range d.segments {
+		if seg.dl != nil {
+			seg.dl.Close()
+		}
+	}
+	d.file.Close()
+	delete(d.client.multiSourceDownloads, d)
+}
+
+func (d *MultiSourceDownload) do() {
+	defer d.client.wg.Done()
+
+	d.client.Safe(func() {
+		if !d.terminateRequested {
+			d.start()
+		}
+	})
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.client.Safe(func() {
+				if !d.terminateRequested {
+					d.handleTick()
+				}
+			})
+
+		case <-d.terminate:
+			return
+		}
+	}
+}
+
+// peerOf returns the current peer of a source, since peers are recreated
+// when they reconnect.
+func (d *MultiSourceDownload) peerOf(src *multiSourceSource) *Peer {
+	if src.peer.Hub.state != hubInitialized {
+		return nil
+	}
+	return src.peer.Hub.peerByNick(src.peer.Nick)
+}
+
+func (d *MultiSourceDownload) isUsable(src *multiSourceSource) bool {
+	return src.failures < multiSourceMaxFailures && d.peerOf(src) != nil
+}
+
+// start requests the TTH leaves or assigns segments to sources, depending on
+// the download progress. It is called again when sources may have come online.
+func (d *MultiSourceDownload) start() {
+	switch {
+	case d.segments != nil:
+		d.schedule()
+
+	case d.leavesDl != nil:
+
+	// small files are verified directly through their TTH
+	case d.conf.Size <= d.conf.SegmentSize:
+		d.handleLeaves(tiger.Leaves{d.conf.TTH})
+
+	default:
+		d.requestLeaves()
+	}
+}
+
+// hasOfflineSources checks whether some sources, that are not connected,
+// may be used when they come online.
+func (d *MultiSourceDownload) hasOfflineSources(tthl bool) bool {
+	for _, src := range d.sources {
+		if src.failures < multiSourceMaxFailures && !(tthl && src.tthlFailed) && d.peerOf(src) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *MultiSourceDownload) requestLeaves() {
+	for _, src := range d.sources {
+		if src.tthlFailed || !d.isUsable(src) {
+			continue
+		}
+
+		log.Log(d.client.conf.LogLevel, log.LevelDebug, "[download] [%s] requesting TTH leaves", src.peer.Nick)
+
+		src := src
+		d.leavesDl, _ = d.client.DownloadFile(DownloadConf{
+			Peer:   d.peerOf(src),
+			TTH:    d.conf.TTH,
+			isTTHL: true,
+			onExit: func(dl *Download, err error) {
+				d.handleLeavesExit(src, dl, err)
+			},
+		})
+		return
+	}
+
+	// wait for sources to come online
+	if d.hasOfflineSources(true) {
+		return
+	}
+
+	d.handleExit(fmt.Errorf("unable to download TTH leaves from any source"))
+}
+
+func (d *MultiSourceDownload) handleLeavesExit(src *multiSourceSource, dl *Download, err error) {
+	if d.terminateRequested {
+		return
+	}
+	d.leavesDl = nil
+
+	if err == nil {
+		var leaves tiger.Leaves
+		leaves, err = tiger.LeavesLoadFromBytes(dl.Content())
+		if err == nil && leaves.TreeHash() != d.conf.TTH {
+			err = fmt.Errorf("TTH leaves do not match TTH")
+		}
+		if err == nil {
+			d.handleLeaves(leaves)
+			return
+		}
+	}
+
+	log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] unable to get TTH leaves: %s",
+		src.peer.Nick, err)
+	src.tthlFailed = true
+	d.requestLeaves()
+}
+
+func (d *MultiSourceDownload) handleLeaves(leaves tiger.Leaves) {
+	bs, err := leaves.BlockSize(d.conf.Size)
+	if err != nil {
+		d.handleExit(err)
+		return
+	}
+	d.leaves = leaves
+	d.blockSize = bs
+
+	segSize := ((d.conf.SegmentSize + bs - 1) / bs) * bs
+	for start := uint64(0); start < d.conf.Size; start += segSize {
+		length := segSize
+		if (start + length) > d.conf.Size {
+			length = d.conf.Size - start
+		}
+		d.segments = append(d.segments, &multiSourceSegment{
+			start:  start,
+			length: length,
+		})
+	}
+
+	d.schedule()
+}
+
+// schedule assigns pending segments to idle sources, preferring the ones
+// that are not slow.
+func (d *MultiSourceDownload) schedule() {
+	// leaves not received yet
+	if d.segments == nil {
+		return
+	}
+
+	done := true
+	active := false
+	for _, seg := range d.segments {
+		if !seg.done {
+			done = false
+		}
+		if seg.dl != nil || seg.verifying {
+			active = true
+		}
+	}
+
+	if done {
+		d.handleExit(nil)
+		return
+	}
+
+	for _, slow := range []bool{false, true} {
+		for _, src := range d.sources {
+			if src.seg != nil || src.slow != slow || !d.isUsable(src) {
+				continue
+			}
+
+			seg := d.nextSegment()
+			if seg == nil {
+				return
+			}
+
+			d.startSegment(src, seg)
+			active = true
+		}
+	}
+
+	// wait for sources to come online
+	if !active && !d.hasOfflineSources(false) {
+		d.handleExit(fmt.Errorf("no sources available"))
+	}
+}
+
+func (d *MultiSourceDownload) nextSegment() *multiSourceSegment {
+	for _, seg := range d.segments {
+		if !seg.done && !seg.verifying && seg.dl == nil {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (d *MultiSourceDownload) startSegment(src *multiSourceSource, seg *multiSourceSegment) {
+	log.Log(d.client.conf.LogLevel, log.LevelDebug, "[download] [%s] assigning segment (s=%d l=%d)",
+		src.peer.Nick, seg.start, seg.length)
+
+	src.seg = seg
+	seg.processingSince = time.Time{}
+	seg.dl, _ = d.client.DownloadFile(DownloadConf{
+		Peer:   d.peerOf(src),
+		TTH:    d.conf.TTH,
+		Start:  seg.start,
+		Length: int64(seg.length),
+		onExit: func(dl *Download, err error) {
+			d.handleSegmentExit(src, seg, dl, err)
+		},
+	})
+}
+
+func (d *MultiSourceDownload) handleSegmentExit(src *multiSourceSource,
+	seg *multiSourceSegment, dl *Download, err error,
+) {
+	if d.terminateRequested {
+		return
+	}
+	src.seg = nil
+	seg.dl = nil
+
+	// download was stopped since the source was slow
+	if dl.terminateRequested {
+		d.schedule()
+		return
+	}
+
+	if err == nil && uint64(len(dl.Content())) != seg.length {
+		err = fmt.Errorf("segment has wrong size (%d instead of %d)", len(dl.Content()), seg.length)
+	}
+
+	if err != nil {
+		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] segment failed (s=%d l=%d): %s",
+			src.peer.Nick, seg.start, seg.length, err)
+		src.failures++
+		d.schedule()
+		return
+	}
+
+	// hashing is slow, therefore the segment is verified outside the client mutex
+	seg.verifying = true
+	d.client.wg.Add(1)
+	go d.verifySegment(src, seg, dl.Content())
+
+	d.schedule()
+}
+
+func (d *MultiSourceDownload) verifySegment(src *multiSourceSource, seg *multiSourceSegment, content []byte) {
+	defer d.client.wg.Done()
+
+	verified := false
+	err := func() error {
+		// verify every block of the segment
+		for off := uint64(0); off < seg.length; off += d.blockSize {
+			end := off + d.blockSize
+			if end > seg.length {
+				end = seg.length
+			}
+
+			if tiger.HashFromBytes(content[off:end]) != d.leaves[(seg.start+off)/d.blockSize] {
+				return fmt.Errorf("segment verification failed")
+			}
+		}
+		verified = true
+
+		_, err := d.file.WriteAt(content, int64(seg.start))
+		return err
+	}()
+
+	d.client.Safe(func() {
+		if d.terminateRequested {
+			return
+		}
+		seg.verifying = false
+
+		if err != nil {
+			log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] segment failed (s=%d l=%d): %s",
+				src.peer.Nick, seg.start, seg.length, err)
+
+			// do not use this source anymore
+			if !verified {
+				src.failures = multiSourceMaxFailures
+			}
+		} else {
+			seg.done = true
+			src.received += seg.length
+
+			if d.client.OnMultiSourceDownloadProgress != nil {
+				d.client.OnMultiSourceDownloadProgress(d, src.peer, src.received)
+			}
+		}
+
+		d.schedule()
+	})
+}
+
+func (d *MultiSourceDownload) handleTick() {
+	idle := false
+	for _, src := range d.sources {
+		if src.seg == nil && !src.slow && d.isUsable(src) {
+			idle = true
+			break
+		}
+	}
+
+	for _, src := range d.sources {
+		seg := src.seg
+		if seg == nil || seg.dl == nil || seg.dl.state != "processing" {
+			continue
+		}
+
+		if seg.processingSince.IsZero() {
+			seg.processingSince = time.Now()
+		}
+
+		if d.client.OnMultiSourceDownloadProgress != nil {
+			d.client.OnMultiSourceDownloadProgress(d, src.peer, src.received+seg.dl.offset)
+		}
+
+		// re-assign the segment to an idle source if this one is slow
+		elapsed := time.Since(seg.processingSince)
+		if idle && elapsed >= multiSourceSlowPeriod &&
+			float64(seg.dl.offset)/elapsed.Seconds() < float64(d.conf.MinSegmentSpeed) {
+			log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] [%s] source is slow, re-assigning segment",
+				src.peer.Nick)
+			src.slow = true
+			seg.dl.Close()
+		}
+	}
+}
+
+func (d *MultiSourceDownload) handleExit(err error) {
+	if d.terminateRequested {
+		return
+	}
+	d.terminateRequested = true
+	d.cleanup()
+
+	if err == nil {
+		err = os.Rename(d.conf.SavePath+".tmp", d.conf.SavePath)
+	}
+
+	if err == nil {
+		log.Log(d.client.conf.LogLevel, log.LevelInfo, "[download] finished %s (size=%d)",
+			d.conf.TTH, d.conf.Size)
+		if d.client.OnMultiSourceDownloadSuccessful != nil {
+			d.client.OnMultiSourceDownloadSuccessful(d)
+		}
+	} else {
+		log.Log(d.client.conf.LogLevel, log.LevelInfo, "ERR (download) %s: %s", d.conf.TTH, err)
+		if d.client.OnMultiSourceDownloadError != nil {
+			d.client.OnMultiSourceDownloadError(d, err)
+		}
+	}
+}
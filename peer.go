@@ -13,6 +13,8 @@ import (
 
 // Peer represents a remote client connected to a Hub.
 type Peer struct {
+	// the hub the peer is connected to
+	Hub *Hub
 	// peer nickname
 	Nick string
 	// peer description (if provided)
@@ -43,20 +45,38 @@ type Peer struct {
 	nmdcFlag       nmdc.UserFlag
 }
 
-// Peers returns a map containing all the peers connected to current hub.
+type hubNickPair struct {
+	hub  *Hub
+	nick string
+}
+
+// Peers returns a map containing all the peers connected to any hub.
+// When a nick is in use in multiple hubs, only one of the peers is returned;
+// use Hub.Peers() to get the peers of a specific hub.
 func (c *Client) Peers() map[string]*Peer {
-	return c.peers
+	ret := make(map[string]*Peer)
+	for i := len(c.hubs) - 1; i >= 0; i-- {
+		for nick, p := range c.hubs[i].peers {
+			ret[nick] = p
+		}
+	}
+	return ret
 }
 
-func (c *Client) peerByNick(nick string) *Peer {
-	if p, ok := c.peers[nick]; ok {
+// Peers returns a map containing all the peers connected to the hub.
+func (h *Hub) Peers() map[string]*Peer {
+	return h.peers
+}
+
+func (h *Hub) peerByNick(nick string) *Peer {
+	if p, ok := h.peers[nick]; ok {
 		return p
 	}
 	return nil
 }
 
-func (c *Client) peerBySessionID(sessionID adc.SID) *Peer {
-	for _, p := range c.peers {
+func (h *Hub) peerBySessionID(sessionID adc.SID) *Peer {
+	for _, p := range h.peers {
 		if p.adcSessionID == sessionID {
 			return p
 		}
@@ -64,8 +84,8 @@ func (c *Client) peerBySessionID(sessionID adc.SID) *Peer {
 	return nil
 }
 
-func (c *Client) peerByClientID(clientID adc.CID) *Peer {
-	for _, p := range c.peers {
+func (h *Hub) peerByClientID(clientID adc.CID) *Peer {
+	for _, p := range h.peers {
 		if p.adcClientID == clientID {
 			return p
 		}
@@ -73,12 +93,45 @@ func (c *Client) peerByClientID(clientID adc.CID) *Peer {
 	return nil
 }
 
+// peerByNick returns a peer with the given nick, connected to any hub that
+// uses the given protocol. Peers with a pending download are preferred.
+func (c *Client) peerByNick(proto protocolName, nick string) *Peer {
+	for _, h := range c.hubs {
+		if h.getProto() == proto {
+			if p := h.peerByNick(nick); p != nil && c.downloadPendingByPeer(p) != nil {
+				return p
+			}
+		}
+	}
+	for _, h := range c.hubs {
+		if h.getProto() == proto {
+			if p := h.peerByNick(nick); p != nil {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// peerByClientID returns a peer with the given client ID, connected to any
+// ADC hub.
+func (c *Client) peerByClientID(clientID adc.CID) *Peer {
+	for _, h := range c.hubs {
+		if h.protoIsAdc() {
+			if p := h.peerByClientID(clientID); p != nil {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Client) peerSupportsAdc(p *Peer, f adc.Feature) bool {
 	return p.adcFeatures.Has(f)
 }
 
 func (c *Client) peerSupportsEncryption(p *Peer) bool {
-	if c.protoIsAdc() {
+	if p.Hub.protoIsAdc() {
 		if p.adcFingerprint != "" {
 			return true
 		}
@@ -101,9 +154,10 @@ func (c *Client) peerRequestConnection(peer *Peer, adcToken string) {
 }
 
 func (c *Client) peerConnectToMe(peer *Peer, adcToken string) {
-	if c.protoIsAdc() {
-		c.hubConn.conn.Write(&protoadc.AdcDConnectToMe{ //nolint:govet
-			&adc.DirectPacket{ID: c.adcSessionID, To: peer.adcSessionID},
+	h := peer.Hub
+	if h.protoIsAdc() {
+		h.conn.Write(&protoadc.AdcDConnectToMe{ //nolint:govet
+			&adc.DirectPacket{ID: h.adcSessionID, To: peer.adcSessionID},
 			&adc.ConnectRequest{ //nolint:govet
 				func() string {
 					if c.conf.PeerEncryptionMode != DisableEncryption && c.peerSupportsEncryption(peer) {
@@ -121,7 +175,7 @@ func (c *Client) peerConnectToMe(peer *Peer, adcToken string) {
 			},
 		})
 	} else {
-		c.hubConn.conn.Write(&nmdc.ConnectToMe{
+		h.conn.Write(&nmdc.ConnectToMe{
 			Targ: peer.Nick,
 			Address: fmt.Sprintf("%s:%d", c.ip, func() uint {
 				if c.conf.PeerEncryptionMode != DisableEncryption && c.peerSupportsEncryption(peer) {
@@ -135,9 +189,10 @@ func (c *Client) peerConnectToMe(peer *Peer, adcToken string) {
 }
 
 func (c *Client) peerRevConnectToMe(peer *Peer, adcToken string) {
-	if c.protoIsAdc() {
-		c.hubConn.conn.Write(&protoadc.AdcDRevConnectToMe{ //nolint:govet
-			&adc.DirectPacket{ID: c.adcSessionID, To: peer.adcSessionID},
+	h := peer.Hub
+	if h.protoIsAdc() {
+		h.conn.Write(&protoadc.AdcDRevConnectToMe{ //nolint:govet
+			&adc.DirectPacket{ID: h.adcSessionID, To: peer.adcSessionID},
 			&adc.RevConnectRequest{ //nolint:govet
 				func() string {
 					if c.conf.PeerEncryptionMode != DisableEncryption && c.peerSupportsEncryption(peer) {
@@ -149,19 +204,42 @@ func (c *Client) peerRevConnectToMe(peer *Peer, adcToken string) {
 			},
 		})
 	} else {
-		c.hubConn.conn.Write(&nmdc.RevConnectToMe{
-			From: c.conf.Nick,
+		h.conn.Write(&nmdc.RevConnectToMe{
+			From: h.nick,
 			To:   peer.Nick,
 		})
 	}
 }
 
 func (c *Client) handlePeerConnected(peer *Peer) {
-	c.peers[peer.Nick] = peer
+	peer.Hub.peers[peer.Nick] = peer
+
+	// peer may have reconnected; update downloads that are still waiting
+	for t := range c.transfers {
+		if d, ok := t.(*Download); ok {
+			if d.conf.Peer != peer && d.conf.Peer.Hub == peer.Hub && d.conf.Peer.Nick == peer.Nick {
+				d.conf.Peer = peer
+			}
+		}
+	}
+
 	log.Log(c.conf.LogLevel, log.LevelInfo, "[hub] [peer on] %s (%v)", peer.Nick, peer.ShareSize)
 	if c.OnPeerConnected != nil {
 		c.OnPeerConnected(peer)
 	}
+
+	if fav := c.FavoriteByPeer(peer); fav != nil && c.OnFavoriteOnline != nil {
+		c.OnFavoriteOnline(fav, peer)
+	}
+
+	// peer may be a source of queued downloads
+	c.queueResetSources(peer)
+	c.queueSchedule()
+
+	// peer may be a source of multi-source downloads
+	for d := range c.multiSourceDownloads {
+		d.start()
+	}
 }
 
 func (c *Client) handlePeerUpdated(peer *Peer) {
@@ -171,11 +249,15 @@ func (c *Client) handlePeerUpdated(peer *Peer) {
 }
 
 func (c *Client) handlePeerDisconnected(peer *Peer) {
-	delete(c.peers, peer.Nick)
+	delete(peer.Hub.peers, peer.Nick)
 	log.Log(c.conf.LogLevel, log.LevelInfo, "[hub] [peer off] %s", peer.Nick)
 	if c.OnPeerDisconnected != nil {
 		c.OnPeerDisconnected(peer)
 	}
+
+	if fav := c.FavoriteByPeer(peer); fav != nil && c.OnFavoriteOffline != nil {
+		c.OnFavoriteOffline(fav, peer)
+	}
 }
 
 func (c *Client) handlePeerRevConnectToMe(peer *Peer, adcToken string) {
@@ -3,6 +3,7 @@ package dctk
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -18,17 +19,21 @@ import (
 var errorDelegatedUpload = fmt.Errorf("delegated upload")
 
 type nickDirectionPair struct {
+	hub       *Hub
 	nick      string
 	direction string
 }
 
 type peerConn struct {
 	client             *Client
+	hub                *Hub
+	proto              protocolName
 	isEncrypted        bool
 	isActive           bool
 	terminateRequested bool
 	terminate          chan struct{}
 	state              string
+	rawconn            net.Conn
 	conn               conn
 	tlsConn            *tls.Conn
 	adcToken           string
@@ -41,17 +46,20 @@ type peerConn struct {
 	remoteBet          uint
 	direction          string
 	transfer           transfer
+	limiter            *rateLimiter
 }
 
-func newPeerConn(client *Client, isEncrypted bool, isActive bool,
+func newPeerConn(client *Client, hub *Hub, isEncrypted bool, isActive bool,
 	rawconn net.Conn, ip string, port uint, adcToken string,
 ) *peerConn {
 	p := &peerConn{
 		client:      client,
+		hub:         hub,
 		isEncrypted: isEncrypted,
 		isActive:    isActive,
 		terminate:   make(chan struct{}),
 		adcToken:    adcToken,
+		limiter:     newRateLimiter(0),
 	}
 	p.client.peerConns[p] = struct{}{}
 
@@ -63,14 +71,10 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 			return ""
 		}())
 		p.state = "connected"
+		p.rawconn = rawconn
 		if p.isEncrypted {
 			p.tlsConn = rawconn.(*tls.Conn)
 		}
-		if client.protoIsAdc() {
-			p.conn = protoadc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
-		} else {
-			p.conn = protonmdc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
-		}
 	} else {
 		log.Log(client.conf.LogLevel, log.LevelInfo, "[peer] outgoing %s:%d%s", ip, port, func() string {
 			if p.isEncrypted {
@@ -79,6 +83,7 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 			return ""
 		}())
 		p.state = "connecting"
+		p.proto = hub.getProto()
 		p.passiveIP = ip
 		p.passivePort = port
 	}
@@ -88,6 +93,29 @@ func newPeerConn(client *Client, isEncrypted bool, isActive bool,
 	return p
 }
 
+// peerDetectProto reads the first byte sent through an incoming connection,
+// in order to detect the protocol in use, since the peer can belong to any hub.
+// ADC messages start with the message type, while NMDC messages start with $.
+func peerDetectProto(rawconn net.Conn) (protocolName, net.Conn, error) {
+	rawconn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var buf [1]byte
+	_, err := io.ReadFull(rawconn, buf[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	rawconn.SetReadDeadline(time.Time{})
+
+	pconn := &prefixedConn{Conn: rawconn, prefix: buf[:]}
+	if buf[0] == '$' {
+		return protocolNMDC, pconn, nil
+	}
+	return protocolADC, pconn, nil
+}
+
+func (p *peerConn) protoIsAdc() bool {
+	return p.proto == protocolADC
+}
+
 func (p *peerConn) close() {
 	if p.terminateRequested {
 		return
@@ -100,6 +128,38 @@ func (p *peerConn) do() {
 	defer p.client.wg.Done()
 
 	err := func() error {
+		// detect protocol of incoming connection
+		if p.isActive {
+			var proto protocolName
+			var rawconn net.Conn
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				proto, rawconn, err = peerDetectProto(p.rawconn)
+			}()
+
+			select {
+			case <-p.terminate:
+				p.rawconn.Close()
+				<-done
+				return protocommon.ErrorTerminated
+			case <-done:
+			}
+
+			if err != nil {
+				p.rawconn.Close()
+				return err
+			}
+
+			p.proto = proto
+			if p.protoIsAdc() {
+				p.conn = protoadc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
+			} else {
+				p.conn = protonmdc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
+			}
+		}
+
 		// connect to peer
 		connect := false
 		p.client.Safe(func() {
@@ -128,7 +188,7 @@ func (p *peerConn) do() {
 				rawconn = p.tlsConn
 			}
 
-			if p.client.protoIsAdc() {
+			if p.protoIsAdc() {
 				p.conn = protoadc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
 			} else {
 				p.conn = protonmdc.NewConn(p.client.conf.LogLevel, "p", rawconn, true, true)
@@ -147,7 +207,7 @@ func (p *peerConn) do() {
 				}())
 
 			// if transfer is passive, we are the first to talk
-			if p.client.protoIsAdc() {
+			if p.protoIsAdc() {
 				p.conn.Write(&protoadc.AdcCSupports{ //nolint:govet
 					&adc.ClientPacket{},
 					&adc.Supported{adc.ModFeatures{ //nolint:govet
@@ -159,11 +219,11 @@ func (p *peerConn) do() {
 					}},
 				})
 			} else {
-				p.conn.Write(&nmdc.MyNick{Name: nmdc.Name(p.client.conf.Nick)})
+				p.conn.Write(&nmdc.MyNick{Name: nmdc.Name(p.hub.nick)})
 				p.conn.Write(&nmdc.Lock{
 					Lock: "EXTENDEDPROTOCOLABCABCABCABCABCABC",
 					PK:   p.client.conf.PkValue,
-					Ref:  fmt.Sprintf("%s:%d", p.client.hubSolvedIP, p.client.hubPort),
+					Ref:  fmt.Sprintf("%s:%d", p.hub.solvedIP, p.hub.port),
 				})
 			}
 		}
@@ -177,6 +237,12 @@ func (p *peerConn) do() {
 						return err
 					}
 
+					// limit download speed outside the client context
+					if bin, ok := msg.(*protocommon.MsgBinary); ok {
+						p.client.downloadLimiter.wait(len(bin.Content))
+						p.limiter.wait(len(bin.Content))
+					}
+
 					p.client.Safe(func() {
 						// pre-transfer
 						if p.state != "delegated_download" {
@@ -197,7 +263,7 @@ func (p *peerConn) do() {
 
 					// upload
 					if err == errorDelegatedUpload {
-						u := p.transfer.(*upload)
+						u := p.transfer.(*Upload)
 
 						err := u.handleUpload()
 						if err != nil {
@@ -246,7 +312,7 @@ func (p *peerConn) do() {
 		delete(p.client.peerConns, p)
 
 		if p.peer != nil && p.direction != "" {
-			delete(p.client.peerConnsByKey, nickDirectionPair{p.peer.Nick, p.direction})
+			delete(p.client.peerConnsByKey, nickDirectionPair{p.peer.Hub, p.peer.Nick, p.direction})
 		}
 
 		log.Log(p.client.conf.LogLevel, log.LevelInfo, "[peer] disconnected")
@@ -293,10 +359,21 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 		p.state = "infos"
 
-		p.peer = p.client.peerByClientID(msg.Msg.Id)
+		if p.hub != nil {
+			p.peer = p.hub.peerByClientID(msg.Msg.Id)
+		} else {
+			// the token allows to find the hub of the peer we requested a connection to
+			if dl := p.client.downloadByAdcToken(msg.Msg.Token); dl != nil {
+				p.peer = dl.conf.Peer.Hub.peerByClientID(msg.Msg.Id)
+			}
+			if p.peer == nil {
+				p.peer = p.client.peerByClientID(msg.Msg.Id)
+			}
+		}
 		if p.peer == nil {
 			return fmt.Errorf("unknown client id (%s)", msg.Msg.Id)
 		}
+		p.hub = p.peer.Hub
 
 		if p.isActive {
 			if msg.Msg.Token == "" {
@@ -316,7 +393,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			// validate peer fingerprint
 			// can be performed on client-side only since many clients do not send
 			// their certificate when in passive mode
-		} else if p.client.protoIsAdc() && p.isEncrypted &&
+		} else if p.isEncrypted &&
 			p.peer.adcFingerprint != "" {
 			connFingerprint := protoadc.AdcCertFingerprint(
 				p.tlsConn.ConnectionState().PeerCertificates[0])
@@ -330,7 +407,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 		dl := p.client.downloadByAdcToken(p.adcToken)
 		if dl != nil {
-			key := nickDirectionPair{p.peer.Nick, "download"}
+			key := nickDirectionPair{p.peer.Hub, p.peer.Nick, "download"}
 			if _, ok := p.client.peerConnsByKey[key]; ok {
 				return fmt.Errorf("a connection with this peer and direction already exists")
 			}
@@ -343,7 +420,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			dl.state = "processing"
 			dl.peerChan <- struct{}{}
 		} else {
-			key := nickDirectionPair{p.peer.Nick, "upload"}
+			key := nickDirectionPair{p.peer.Hub, p.peer.Nick, "upload"}
 			if _, ok := p.client.peerConnsByKey[key]; ok {
 				return fmt.Errorf("a connection with this peer and direction already exists")
 			}
@@ -369,10 +446,15 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("[MyNick] invalid state: %s", p.state)
 		}
 		p.state = "mynick"
-		p.peer = p.client.peerByNick(string(msg.Name))
+		if p.hub != nil {
+			p.peer = p.hub.peerByNick(string(msg.Name))
+		} else {
+			p.peer = p.client.peerByNick(protocolNMDC, string(msg.Name))
+		}
 		if p.peer == nil {
 			return fmt.Errorf("peer not connected to hub (%s)", msg.Name)
 		}
+		p.hub = p.peer.Hub
 
 	case *nmdc.Lock:
 		if p.state != "mynick" {
@@ -382,7 +464,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 
 		// if transfer is active, wait remote before sending MyNick and Lock
 		if p.isActive {
-			p.conn.Write(&nmdc.MyNick{Name: nmdc.Name(p.client.conf.Nick)})
+			p.conn.Write(&nmdc.MyNick{Name: nmdc.Name(p.hub.nick)})
 			p.conn.Write(&nmdc.Lock{
 				Lock: "EXTENDEDPROTOCOLABCABCABCABCABCABC",
 				PK:   p.client.conf.PkValue,
@@ -390,12 +472,14 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 		}
 
 		features := []string{
-			nmdc.ExtMinislots,
 			nmdc.ExtXmlBZList,
 			nmdc.ExtADCGet,
 			nmdc.ExtTTHL,
 			nmdc.ExtTTHF,
 		}
+		if p.client.conf.UploadMiniSlots != 0 {
+			features = append(features, nmdc.ExtMinislots)
+		}
 		if !p.client.conf.PeerDisableCompression {
 			features = append(features, nmdc.ExtZLIG)
 		}
@@ -473,7 +557,7 @@ func (p *peerConn) handleMessage(msgi protocommon.MsgDecodable) error {
 			return fmt.Errorf("double upload request")
 		}
 
-		key := nickDirectionPair{p.peer.Nick, direction}
+		key := nickDirectionPair{p.peer.Hub, p.peer.Nick, direction}
 		if _, ok := p.client.peerConnsByKey[key]; ok {
 			return fmt.Errorf("a connection with this peer and direction already exists")
 		}
@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/aler9/go-dc/adc"
@@ -21,6 +22,7 @@ import (
 // standard ADC status codes.
 const (
 	AdcCodeProtocolUnsupported = 41
+	AdcCodeTransferGeneric     = 50
 	AdcCodeFileNotAvailable    = 51
 	AdcCodeSlotsFull           = 53
 )
@@ -194,6 +196,12 @@ func (p *Conn) Write(pktMsg protocommon.MsgEncodable) {
 	p.BaseConn.Write(buf.Bytes())
 }
 
+// WriteRaw writes raw data, that must contain one or more complete messages.
+func (p *Conn) WriteRaw(in []byte) {
+	log.Log(p.LogLevel(), log.LevelDebug, "[c->%s] raw %q", p.RemoteLabel(), in)
+	p.BaseConn.Write(in)
+}
+
 // AdcKeepAlive is an ADC keepalive.
 type AdcKeepAlive struct{}
 
@@ -249,6 +257,33 @@ type AdcCStatus struct {
 	Msg *adc.Status
 }
 
+// AdcStatusQueued is a STA message that contains a queue position (QP parameter).
+type AdcStatusQueued struct {
+	adc.Status
+	Position int
+}
+
+// Cmd implements adc.Message.
+func (*AdcStatusQueued) Cmd() adc.MsgType {
+	return adc.MsgType{'S', 'T', 'A'}
+}
+
+// MarshalADC implements adc.Marshaler.
+func (st *AdcStatusQueued) MarshalADC(buf *bytes.Buffer) error {
+	err := st.Status.MarshalADC(buf)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(" QP" + strconv.Itoa(st.Position))
+	return nil
+}
+
+// AdcCStatusQueued is the CSTA message with a queue position.
+type AdcCStatusQueued struct {
+	Pkt *adc.ClientPacket
+	Msg *AdcStatusQueued
+}
+
 // AdcCSupports is the CSUP message.
 type AdcCSupports struct {
 	Pkt *adc.ClientPacket
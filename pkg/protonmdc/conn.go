@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 
 	"github.com/aler9/go-dc/nmdc"
 
@@ -89,7 +90,7 @@ func (p *Conn) Read() (protocommon.MsgDecodable, error) {
 					case "LogedIn":
 						return &nmdc.LogedIn{}
 					case "MaxedOut":
-						return &nmdc.MaxedOut{}
+						return &NmdcMaxedOut{}
 					case "MyINFO":
 						return &nmdc.MyINFO{}
 					case "MyNick":
@@ -194,5 +195,43 @@ func (p *Conn) Write(msg protocommon.MsgEncodable) {
 	p.BaseConn.Write(buf.Bytes())
 }
 
+// WriteRaw writes raw data, that must contain one or more complete messages.
+func (p *Conn) WriteRaw(in []byte) {
+	log.Log(p.LogLevel(), log.LevelDebug, "[c->%s] raw %q", p.RemoteLabel(), in)
+	p.BaseConn.Write(in)
+}
+
 // NmdcKeepAlive is a NMDC keepalive.
 type NmdcKeepAlive struct{}
+
+// NmdcMaxedOut is the MaxedOut message, with an optional queue position.
+type NmdcMaxedOut struct {
+	Position uint
+}
+
+// Type implements nmdc.Message.
+func (*NmdcMaxedOut) Type() string {
+	return "MaxedOut"
+}
+
+// MarshalNMDC implements nmdc.Message.
+func (m *NmdcMaxedOut) MarshalNMDC(_ *nmdc.TextEncoder, buf *bytes.Buffer) error {
+	if m.Position != 0 {
+		buf.WriteString(strconv.FormatUint(uint64(m.Position), 10))
+	}
+	return nil
+}
+
+// UnmarshalNMDC implements nmdc.Message.
+func (m *NmdcMaxedOut) UnmarshalNMDC(_ *nmdc.TextDecoder, data []byte) error {
+	m.Position = 0
+	if len(data) == 0 {
+		return nil
+	}
+	pos, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid queue position: %s", data)
+	}
+	m.Position = uint(pos)
+	return nil
+}
@@ -3,6 +3,7 @@ package tiger
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 
@@ -133,3 +134,22 @@ func (l Leaves) TreeHash() Hash {
 	h := ttl.TreeHash()
 	return Hash(h)
 }
+
+// BlockSize returns the size of the file part covered by each leaf.
+// Leaves can belong to any level of the tree, therefore the size is
+// the base block size (1024 bytes) multiplied by a power of two.
+func (l Leaves) BlockSize(fileSize uint64) (uint64, error) {
+	if len(l) == 0 {
+		return 0, fmt.Errorf("no leaves")
+	}
+
+	bs := uint64(1024)
+	for ((fileSize + bs - 1) / bs) > uint64(len(l)) {
+		bs *= 2
+	}
+
+	if fileSize > 0 && ((fileSize+bs-1)/bs) != uint64(len(l)) {
+		return 0, fmt.Errorf("leaf count (%d) does not match file size (%d)", len(l), fileSize)
+	}
+	return bs, nil
+}
@@ -0,0 +1,345 @@
+package dctk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+const (
+	// the delay before using again a source after a failed attempt. It is
+	// doubled after every failure, up to queueSourceRetryMaxDelay
+	queueSourceRetryMinDelay = 10 * time.Second
+	queueSourceRetryMaxDelay = 5 * time.Minute
+)
+
+// DownloadPriority is the priority of a queued download.
+type DownloadPriority int
+
+const (
+	// DownloadPriorityPaused means that the download is not started
+	DownloadPriorityPaused DownloadPriority = iota - 3
+	// DownloadPriorityLowest is the lowest priority
+	DownloadPriorityLowest
+	// DownloadPriorityLow is a low priority
+	DownloadPriorityLow
+	// DownloadPriorityNormal is the default priority
+	DownloadPriorityNormal
+	// DownloadPriorityHigh is a high priority
+	DownloadPriorityHigh
+	// DownloadPriorityHighest is the highest priority
+	DownloadPriorityHighest
+)
+
+// QueueSource is a peer that owns a queued file.
+type QueueSource struct {
+	// the url of the hub of the peer
+	HubURL string
+	// the nickname of the peer
+	Nick string
+
+	failures uint
+	retryAt  time.Time
+}
+
+// QueueItem is a file in the download queue.
+type QueueItem struct {
+	// the TTH of the file
+	TTH tiger.Hash
+	// the path where the file is saved
+	SavePath string
+	// the size of the file
+	Size uint64
+	// the priority of the download
+	Priority DownloadPriority
+	// the peers that own the file
+	Sources []*QueueSource
+
+	client *Client
+	dl     *Download
+}
+
+type queueFile struct {
+	Items []*QueueItem
+}
+
+func (c *Client) queueLoad() error {
+	byts, err := os.ReadFile(c.conf.QueueFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var qf queueFile
+	err = json.Unmarshal(byts, &qf)
+	if err != nil {
+		return fmt.Errorf("unable to load queue: %s", err)
+	}
+
+	for _, item := range qf.Items {
+		item.client = c
+	}
+	c.queue = qf.Items
+	return nil
+}
+
+func (c *Client) queueSave() {
+	if c.conf.QueueFile == "" {
+		return
+	}
+
+	byts, err := json.MarshalIndent(queueFile{Items: c.queue}, "", "  ")
+	if err == nil {
+		// write to a temporary file in order not to corrupt the queue in case of crash
+		err = os.WriteFile(c.conf.QueueFile+".tmp", byts, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(c.conf.QueueFile+".tmp", c.conf.QueueFile)
+	}
+	if err != nil {
+		log.Log(c.conf.LogLevel, log.LevelInfo, "ERR: unable to save queue: %s", err)
+	}
+}
+
+// QueueAdd adds a file to the download queue. If a file with the same TTH
+// is already queued, it is returned.
+func (c *Client) QueueAdd(tth tiger.Hash, savePath string, size uint64, priority DownloadPriority) *QueueItem {
+	if item := c.QueueItemByTTH(tth); item != nil {
+		return item
+	}
+
+	item := &QueueItem{
+		TTH:      tth,
+		SavePath: savePath,
+		Size:     size,
+		Priority: priority,
+		client:   c,
+	}
+	c.queue = append(c.queue, item)
+	c.queueSave()
+	return item
+}
+
+// QueueDel removes a file from the download queue, stopping its download.
+func (c *Client) QueueDel(item *QueueItem) {
+	for i, oitem := range c.queue {
+		if oitem == item {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			if item.dl != nil {
+				item.dl.Close()
+				item.dl = nil
+			}
+			c.queueSave()
+			return
+		}
+	}
+}
+
+// Queue returns the files in the download queue.
+func (c *Client) Queue() []*QueueItem {
+	return c.queue
+}
+
+// QueueItemByTTH returns a queued file by its TTH.
+func (c *Client) QueueItemByTTH(tth tiger.Hash) *QueueItem {
+	for _, item := range c.queue {
+		if item.TTH == tth {
+			return item
+		}
+	}
+	return nil
+}
+
+// AddSource adds a peer to the sources of a queued file.
+func (item *QueueItem) AddSource(p *Peer) {
+	for _, src := range item.Sources {
+		if src.HubURL == p.Hub.url && src.Nick == p.Nick {
+			return
+		}
+	}
+	item.Sources = append(item.Sources, &QueueSource{
+		HubURL: p.Hub.url,
+		Nick:   p.Nick,
+	})
+	item.client.queueSave()
+	item.client.queueSchedule()
+}
+
+// SetPriority changes the priority of a queued file. Pausing a file
+// stops its download.
+func (item *QueueItem) SetPriority(priority DownloadPriority) {
+	item.Priority = priority
+	if item.dl != nil {
+		if priority == DownloadPriorityPaused {
+			item.dl.Close()
+			item.dl = nil
+		} else {
+			item.dl.conf.priority = priority
+		}
+	}
+	item.client.queueSave()
+	item.client.queueSchedule()
+}
+
+// Download returns the active download of a queued file, if any.
+func (item *QueueItem) Download() *Download {
+	return item.dl
+}
+
+func (c *Client) queuePeerBySource(src *QueueSource) *Peer {
+	for _, h := range c.hubs {
+		if h.url == src.HubURL && h.state == hubInitialized {
+			return h.peerByNick(src.Nick)
+		}
+	}
+	return nil
+}
+
+// queueSchedule starts downloading queued files, in order of priority,
+// from sources that are online and not busy with other downloads.
+func (c *Client) queueSchedule() {
+	if c.terminateRequested {
+		return
+	}
+
+	items := make([]*QueueItem, len(c.queue))
+	copy(items, c.queue)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Priority > items[j].Priority
+	})
+
+	// activeDownloadsByPeer is filled by the download routines, therefore
+	// peers of downloads started by the queue are tracked separately
+	busy := make(map[hubNickPair]struct{})
+	for _, item := range items {
+		if item.dl != nil {
+			busy[hubNickPair{item.dl.conf.Peer.Hub, item.dl.conf.Peer.Nick}] = struct{}{}
+		}
+	}
+
+	now := time.Now()
+	var nextRetry time.Time
+
+	for _, item := range items {
+		if item.dl != nil || item.Priority == DownloadPriorityPaused {
+			continue
+		}
+
+		for _, src := range item.Sources {
+			// source failed recently
+			if src.retryAt.After(now) {
+				if nextRetry.IsZero() || src.retryAt.Before(nextRetry) {
+					nextRetry = src.retryAt
+				}
+				continue
+			}
+
+			p := c.queuePeerBySource(src)
+			if p == nil {
+				continue
+			}
+			key := hubNickPair{p.Hub, p.Nick}
+			if _, ok := busy[key]; ok {
+				continue
+			}
+			if _, ok := c.activeDownloadsByPeer[key]; ok {
+				continue
+			}
+
+			item := item
+			src := src
+			item.dl, _ = c.DownloadFile(DownloadConf{
+				Peer:     p,
+				TTH:      item.TTH,
+				SavePath: item.SavePath,
+				priority: item.Priority,
+				onExit: func(d *Download, err error) {
+					c.handleQueueDownloadExit(item, src, d, err)
+				},
+			})
+			busy[key] = struct{}{}
+			break
+		}
+	}
+
+	// run again when the first source can be retried
+	if c.queueTimer != nil {
+		c.queueTimer.Stop()
+		c.queueTimer = nil
+	}
+	if !nextRetry.IsZero() {
+		c.queueTimer = time.AfterFunc(time.Until(nextRetry), func() {
+			c.Safe(func() {
+				c.queueSchedule()
+			})
+		})
+	}
+}
+
+// queueResetSources allows to use again the sources that correspond to a
+// peer, when it reconnects.
+func (c *Client) queueResetSources(p *Peer) {
+	for _, item := range c.queue {
+		for _, src := range item.Sources {
+			if src.HubURL == p.Hub.url && src.Nick == p.Nick {
+				src.failures = 0
+				src.retryAt = time.Time{}
+			}
+		}
+	}
+}
+
+func (c *Client) handleQueueDownloadExit(item *QueueItem, src *QueueSource, d *Download, err error) {
+	// item was paused or removed
+	if item.dl != d {
+		return
+	}
+	item.dl = nil
+
+	// download was stopped by the client
+	if d.terminateRequested {
+		return
+	}
+
+	if err == nil {
+		c.QueueDel(item)
+		if c.OnQueueItemFinished != nil {
+			c.OnQueueItemFinished(item)
+		}
+		return
+	}
+
+	// the source is not able to provide the file
+	if err == errorFileNotAvailable || err == errorValidationFailed {
+		for i, osrc := range item.Sources {
+			if osrc == src {
+				item.Sources = append(item.Sources[:i], item.Sources[i+1:]...)
+				break
+			}
+		}
+		c.queueSave()
+
+		// wait before using the source again
+	} else {
+		src.failures++
+		delay := queueSourceRetryMinDelay
+		for i := uint(1); i < src.failures && delay < queueSourceRetryMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > queueSourceRetryMaxDelay {
+			delay = queueSourceRetryMaxDelay
+		}
+		src.retryAt = time.Now().Add(delay)
+	}
+
+	if c.OnQueueItemError != nil {
+		c.OnQueueItemError(item, d.conf.Peer, err)
+	}
+}
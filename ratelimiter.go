@@ -0,0 +1,75 @@
+package dctk
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maximum amount of bytes that are read or written before waiting
+	rateLimiterChunkSize = 64 * 1024
+)
+
+// rateLimiter is a token bucket that limits the bandwidth of one or more
+// readers or writers. Tokens can go below zero, in which case the caller
+// waits until they are refilled.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allocates a rateLimiter. A rate of zero means no limit.
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+// wait consumes n tokens, waiting if they are not available.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+
+	if l.rate == 0 {
+		l.mutex.Unlock()
+		return
+	}
+
+	// refill tokens. At most one second of tokens can be accumulated
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// setRate changes the rate of the limiter. A rate of zero means no limit.
+func (l *rateLimiter) setRate(rate uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = rate
+	l.last = time.Now()
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	// forgive the debt accumulated with the previous rate
+	if l.tokens < 0 {
+		l.tokens = 0
+	}
+}
@@ -2,7 +2,11 @@ package dctk
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/aler9/go-dc/adc"
 
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/tiger"
@@ -20,6 +24,26 @@ const (
 	SearchTTH
 )
 
+// SearchFileType contains the type of the searched files.
+type SearchFileType int
+
+const (
+	// SearchFileTypeAny searches for files of any type
+	SearchFileTypeAny SearchFileType = iota
+	// SearchFileTypeAudio searches for audio files
+	SearchFileTypeAudio
+	// SearchFileTypeCompressed searches for archives
+	SearchFileTypeCompressed
+	// SearchFileTypeDocument searches for documents
+	SearchFileTypeDocument
+	// SearchFileTypeExecutable searches for executables
+	SearchFileTypeExecutable
+	// SearchFileTypePicture searches for pictures
+	SearchFileTypePicture
+	// SearchFileTypeVideo searches for videos
+	SearchFileTypeVideo
+)
+
 // SearchResult contains a single result received after a search request.
 type SearchResult struct {
 	// whether the search result was received in passive or active mode
@@ -46,108 +70,351 @@ type SearchConf struct {
 	MinSize uint64
 	// the maximum size of the searched file (if type is SearchAny or SearchTTH)
 	MaxSize uint64
+	// the exact size of the searched file (if type is SearchAny). Not supported by NMDC
+	ExactSize uint64
 	// part of a file name (if type is SearchAny), part of a directory name
 	// (if type is SearchAny or SearchDirectory)
 	Query string
+	// additional parts of the path of the searched file or directory, that
+	// must all be present (if type is SearchAny or SearchDirectory)
+	Terms []string
+	// parts that must not be present in the path of the searched file or
+	// directory (if type is SearchAny or SearchDirectory). Not supported by NMDC
+	ExcludedTerms []string
+	// the type of the searched file (if type is SearchAny)
+	FileType SearchFileType
+	// the extensions of the searched file, without dot (if type is SearchAny).
+	// Not supported by NMDC
+	Extensions []string
 	// file TTH (if type is SearchTTH)
 	TTH tiger.Hash
+	// the duration after which the search is closed. It defaults to 30 seconds
+	Timeout time.Duration
+	// OnResult is called when a result of the search is received. Results
+	// with the same peer and TTH are reported once
+	OnResult func(res *SearchResult)
+}
+
+// terms returns the query and the additional terms of a search.
+func (conf *SearchConf) terms() []string {
+	var ret []string
+	if conf.Query != "" {
+		ret = append(ret, conf.Query)
+	}
+	return append(ret, conf.Terms...)
 }
 
 type searchIncomingRequest struct {
-	isActive bool
-	stype    SearchType
-	minSize  uint64
-	maxSize  uint64
-	query    string     // if type is SearchAny or SearchDirectory
-	tth      tiger.Hash // if type is SearchTTH
+	isActive  bool
+	stype     SearchType
+	fileOnly  bool // if type is SearchAny
+	minSize   uint64
+	maxSize   uint64
+	exactSize uint64
+	terms     []string     // if type is SearchAny or SearchDirectory
+	notTerms  []string     // if type is SearchAny or SearchDirectory
+	exts      []string     // if type is SearchAny
+	noExts    []string     // if type is SearchAny
+	group     adc.ExtGroup // if type is SearchAny
+	tth       tiger.Hash   // if type is SearchTTH
 }
 
-// Search starts a file search asynchronously. See SearchConf for the available options.
-func (c *Client) Search(conf SearchConf) error {
-	if c.protoIsAdc() {
-		return c.handleAdcSearchOutgoingRequest(conf)
-	}
-	return c.handleNmdcSearchOutgoingRequest(conf)
+// hasExtFilter checks whether the request is limited to some extensions.
+func (req *searchIncomingRequest) hasExtFilter() bool {
+	return len(req.exts) > 0 || req.group != adc.ExtNone
 }
 
-func (c *Client) handleSearchIncomingRequest(req *searchIncomingRequest) ([]interface{}, error) {
-	var results []interface{}
-	var scanDir func(dname string, dir *shareDirectory, dirAddToResults bool)
+// matchesFile checks whether a file matches the size and extension filters.
+func (req *searchIncomingRequest) matchesFile(name string, size uint64) bool {
+	if (req.minSize != 0 && size < req.minSize) ||
+		(req.maxSize != 0 && size > req.maxSize) ||
+		(req.exactSize != 0 && size != req.exactSize) {
+		return false
+	}
 
-	// search file or directory by name
-	if req.stype == SearchAny || req.stype == SearchDirectory {
-		if len(req.query) < 3 {
-			return nil, fmt.Errorf("query too short: %s", req.query)
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	for _, noExt := range req.noExts {
+		if strings.EqualFold(ext, noExt) {
+			return false
 		}
+	}
 
-		// normalize query
-		req.query = strings.ToLower(req.query)
+	if !req.hasExtFilter() {
+		return true
+	}
 
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			// always add directories
-			if !dirAddToResults {
-				dirAddToResults = strings.Contains(strings.ToLower(dname), req.query)
-			}
-			if dirAddToResults {
-				results = append(results, dir)
-			}
+	for _, e := range req.exts {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return req.group != adc.ExtNone && req.group.Matches(name)
+}
 
-			if req.stype != SearchDirectory {
-				for fname, file := range dir.files {
-					fileAddToResults := dirAddToResults
-					if !fileAddToResults {
-						fileAddToResults = strings.Contains(strings.ToLower(fname), req.query) &&
-							(req.minSize == 0 || file.size > req.minSize) &&
-							(req.maxSize == 0 || file.size < req.maxSize)
-					}
-					if fileAddToResults {
-						results = append(results, file)
-					}
-				}
-			}
+// SearchHandle is a search request. It receives the results that are
+// addressed to it until it is closed.
+type SearchHandle struct {
+	client             *Client
+	conf               SearchConf
+	tokens             map[*Hub]string
+	seen               map[searchResultKey]struct{}
+	aggregator         *SearchAggregator
+	terminateRequested bool
+	terminate          chan struct{}
+}
+
+type searchResultKey struct {
+	peer *Peer
+	tth  tiger.Hash
+	path string
+}
 
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, dirAddToResults)
+func newSearchHandle(c *Client, conf SearchConf) *SearchHandle {
+	if conf.Timeout == 0 {
+		conf.Timeout = 30 * time.Second
+	}
+
+	sh := &SearchHandle{
+		client:     c,
+		conf:       conf,
+		tokens:     make(map[*Hub]string),
+		seen:       make(map[searchResultKey]struct{}),
+		aggregator: NewSearchAggregator(),
+		terminate:  make(chan struct{}),
+	}
+	c.searches[sh] = struct{}{}
+
+	c.wg.Add(1)
+	go sh.do()
+	return sh
+}
+
+// Conf returns the configuration passed at search initialization.
+func (sh *SearchHandle) Conf() SearchConf {
+	return sh.conf
+}
+
+// Aggregator returns the results of the search, grouped by TTH or path.
+// The aggregator is filled by the client, therefore it must be accessed
+// inside a callback or inside Safe().
+func (sh *SearchHandle) Aggregator() *SearchAggregator {
+	return sh.aggregator
+}
+
+// Close stops the search. Results received after closing are not reported
+// to the search anymore.
+func (sh *SearchHandle) Close() {
+	if sh.terminateRequested {
+		return
+	}
+	sh.terminateRequested = true
+	close(sh.terminate)
+	delete(sh.client.searches, sh)
+}
+
+func (sh *SearchHandle) do() {
+	defer sh.client.wg.Done()
+
+	timer := time.NewTimer(sh.conf.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		sh.client.Safe(func() {
+			sh.Close()
+		})
+
+	case <-sh.terminate:
+	}
+}
+
+// searchCheck checks whether a search is supported by the protocol of a hub.
+func searchCheck(h *Hub, conf *SearchConf) error {
+	if !h.protoIsAdc() {
+		return nmdcSearchCheck(conf)
+	}
+	return nil
+}
+
+// matches checks whether a result belongs to the search. In ADC, results are
+// matched by token. In NMDC, that doesn't provide tokens, results are matched
+// against the search request.
+func (sh *SearchHandle) matches(sr *SearchResult, token string) bool {
+	shToken, ok := sh.tokens[sr.Peer.Hub]
+	if !ok {
+		return false
+	}
+
+	if sr.Peer.Hub.protoIsAdc() && token != "" {
+		return token == shToken
+	}
+
+	conf := sh.conf
+	if conf.Type == SearchTTH {
+		return sr.TTH != nil && *sr.TTH == conf.TTH
+	}
+
+	if conf.Type == SearchDirectory && !sr.IsDir {
+		return false
+	}
+
+	path := strings.ToLower(sr.Path)
+	for _, term := range conf.terms() {
+		for _, part := range strings.Fields(strings.ToLower(term)) {
+			if !strings.Contains(path, part) {
+				return false
 			}
 		}
+	}
+	for _, term := range conf.ExcludedTerms {
+		if strings.Contains(path, strings.ToLower(term)) {
+			return false
+		}
+	}
 
-		// search file by TTH
+	if !sr.IsDir {
+		req := &searchIncomingRequest{
+			minSize:   conf.MinSize,
+			maxSize:   conf.MaxSize,
+			exactSize: conf.ExactSize,
+			exts:      conf.Extensions,
+			group:     searchFileTypeAdc[conf.FileType],
+		}
+		if !req.matchesFile(sr.Path, sr.Size) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (sh *SearchHandle) handleResult(sr *SearchResult) {
+	// report results with the same peer and TTH once
+	key := searchResultKey{peer: sr.Peer}
+	if sr.TTH != nil {
+		key.tth = *sr.TTH
 	} else {
-		scanDir = func(dname string, dir *shareDirectory, dirAddToResults bool) {
-			for _, file := range dir.files {
-				if file.tth == req.tth {
-					results = append(results, file)
-				}
-			}
-			for sname, sdir := range dir.dirs {
-				scanDir(sname, sdir, false)
-			}
+		key.path = sr.Path
+	}
+	if _, ok := sh.seen[key]; ok {
+		return
+	}
+	sh.seen[key] = struct{}{}
+	sh.aggregator.Add(sr)
+
+	if sh.conf.OnResult != nil {
+		sh.conf.OnResult(sr)
+	}
+}
+
+// Search starts a file search asynchronously on every connected hub.
+// See SearchConf for the available options.
+func (c *Client) Search(conf SearchConf) (*SearchHandle, error) {
+	// check the search against every hub before sending it to any of them
+	var hubs []*Hub
+	for _, h := range c.hubs {
+		if h.state != hubInitialized {
+			continue
+		}
+		if err := searchCheck(h, &conf); err != nil {
+			return nil, err
 		}
+		hubs = append(hubs, h)
+	}
+
+	sh := newSearchHandle(c, conf)
+	for _, h := range hubs {
+		h.searchEnqueue(sh)
 	}
+	return sh, nil
+}
 
-	// start searching
-	for alias, dir := range c.shareTree {
-		scanDir(alias, dir, false)
+// Search starts a file search asynchronously on the hub.
+// See SearchConf for the available options.
+func (h *Hub) Search(conf SearchConf) (*SearchHandle, error) {
+	if err := searchCheck(h, &conf); err != nil {
+		return nil, err
 	}
 
+	sh := newSearchHandle(h.client, conf)
+	h.searchEnqueue(sh)
+	return sh, nil
+}
+
+func (c *Client) handleSearchIncomingRequest(req *searchIncomingRequest) ([]interface{}, error) {
+	var results []interface{}
+
 	// Implementations should send a maximum of 5 search results to passive users
 	// and 10 search results to active users
+	maxResults := 5
 	if req.isActive {
-		if len(results) > 10 {
-			results = results[:10]
+		maxResults = 10
+	}
+
+	// search file or directory by name
+	if req.stype == SearchAny || req.stype == SearchDirectory {
+		// normalize terms
+		var terms []string
+		for _, term := range req.terms {
+			if term == "" {
+				continue
+			}
+			terms = append(terms, strings.ToLower(term))
+		}
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("query is empty")
 		}
+
+		notTerms := make([]string, len(req.notTerms))
+		for i, term := range req.notTerms {
+			notTerms[i] = strings.ToLower(term)
+		}
+
+		c.shareIndex.search(terms, notTerms, func(n *shareNameNode) bool {
+			if n.dir != nil {
+				// extensions are only available on files
+				if req.fileOnly || req.hasExtFilter() {
+					return true
+				}
+				results = append(results, n.dir)
+			} else {
+				if req.stype == SearchDirectory || !req.matchesFile(n.name, n.file.size) {
+					return true
+				}
+				results = append(results, n.file)
+			}
+			return len(results) < maxResults
+		})
+
+		// search file by TTH
 	} else {
-		if len(results) > 5 {
-			results = results[:5]
+		for _, file := range c.shareByTTH[req.tth] {
+			results = append(results, file)
 		}
 	}
 
+	if len(results) > maxResults {
+		results = results[:maxResults]
+	}
+
+	if len(results) > 0 {
+		c.searchStats.IncomingAnswered++
+	}
+
 	log.Log(c.conf.LogLevel, log.LevelInfo, "[search] req: %+v | sent %d results", req, len(results))
 	return results, nil
 }
 
-func (c *Client) handleSearchResult(sr *SearchResult) {
+func (c *Client) handleSearchResult(sr *SearchResult, token string) {
 	log.Log(c.conf.LogLevel, log.LevelInfo, "[search] res: %+v", sr)
+
+	for sh := range c.searches {
+		if sh.matches(sr, token) {
+			sh.handleResult(sr)
+		}
+	}
+
 	if c.OnSearchResult != nil {
 		c.OnSearchResult(sr)
 	}
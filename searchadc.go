@@ -14,6 +14,16 @@ import (
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
+var searchFileTypeAdc = map[SearchFileType]adc.ExtGroup{
+	SearchFileTypeAny:        adc.ExtNone,
+	SearchFileTypeAudio:      adc.ExtAudio,
+	SearchFileTypeCompressed: adc.ExtArch,
+	SearchFileTypeDocument:   adc.ExtDoc,
+	SearchFileTypeExecutable: adc.ExtExe,
+	SearchFileTypePicture:    adc.ExtImage,
+	SearchFileTypeVideo:      adc.ExtVideo,
+}
+
 func (c *Client) handleAdcSearchResult(isActive bool, peer *Peer, msg *adc.SearchResult) {
 	sr := &SearchResult{
 		IsActive: isActive,
@@ -35,22 +45,29 @@ func (c *Client) handleAdcSearchResult(isActive bool, peer *Peer, msg *adc.Searc
 		sr.Path = strings.TrimSuffix(sr.Path, "/")
 	}
 
-	c.handleSearchResult(sr)
+	c.handleSearchResult(sr, msg.Token)
 }
 
-func (c *Client) handleAdcSearchOutgoingRequest(conf SearchConf) error {
+func (h *Hub) handleAdcSearchOutgoingRequest(conf SearchConf, token string) {
 	req := &adc.SearchRequest{
 		// always add token even if we're not using it
-		Token: protoadc.AdcRandomToken(),
+		Token: token,
 	}
 
 	switch conf.Type {
 	case SearchAny:
-		req.And = append(req.And, conf.Query)
+		req.And = conf.terms()
+		req.Not = conf.ExcludedTerms
+		req.Ext = conf.Extensions
+		req.Group = searchFileTypeAdc[conf.FileType]
+		if conf.ExactSize != 0 {
+			req.Eq = int64(conf.ExactSize)
+		}
 
 	case SearchDirectory:
 		req.Type = adc.FileTypeDir
-		req.And = append(req.And, conf.Query)
+		req.And = conf.terms()
+		req.Not = conf.ExcludedTerms
 
 	case SearchTTH:
 		req.TTH = (*godctiger.Hash)(&conf.TTH)
@@ -70,46 +87,34 @@ func (c *Client) handleAdcSearchOutgoingRequest(conf SearchConf) error {
 	var features []adc.FeatureSel
 
 	// if we're passive, require that the receiver is active
-	if c.conf.IsPassive {
+	if h.client.conf.IsPassive {
 		features = append(features, adc.FeatureSel{adc.FeaTCP4, true}) //nolint:govet
 	}
 
 	if len(features) > 0 {
-		c.hubConn.conn.Write(&protoadc.AdcFSearchRequest{ //nolint:govet
-			&adc.FeaturePacket{ID: c.adcSessionID, Sel: features},
+		h.conn.Write(&protoadc.AdcFSearchRequest{ //nolint:govet
+			&adc.FeaturePacket{ID: h.adcSessionID, Sel: features},
 			req,
 		})
 	} else {
-		c.hubConn.conn.Write(&protoadc.AdcBSearchRequest{ //nolint:govet
-			&adc.BroadcastPacket{ID: c.adcSessionID},
+		h.conn.Write(&protoadc.AdcBSearchRequest{ //nolint:govet
+			&adc.BroadcastPacket{ID: h.adcSessionID},
 			req,
 		})
 	}
-	return nil
 }
 
-func (c *Client) handleAdcSearchIncomingRequest(id adc.SID, req *adc.SearchRequest) {
+func (h *Hub) handleAdcSearchIncomingRequest(id adc.SID, req *adc.SearchRequest) {
+	c := h.client
 	var peer *Peer
 	results, err := func() ([]interface{}, error) {
-		peer = c.peerBySessionID(id)
+		peer = h.peerBySessionID(id)
 		if peer == nil {
 			return nil, fmt.Errorf("search author not found")
 		}
 
-		if req.Group != adc.ExtNone {
-			return nil, fmt.Errorf("search by type is not supported")
-		}
-		if len(req.Ext) > 0 {
-			return nil, fmt.Errorf("search by extension is not supported")
-		}
-		if len(req.Not) > 0 {
-			return nil, fmt.Errorf("search by OR is not supported")
-		}
-		if req.Eq != 0 {
-			return nil, fmt.Errorf("search by exact size is not supported")
-		}
-		if req.Type == adc.FileTypeFile {
-			return nil, fmt.Errorf("file-only search is not supported")
+		if !c.searchIncomingAllowed(h.url + " " + peer.Nick) {
+			return nil, fmt.Errorf("rate limit of %s exceeded", peer.Nick)
 		}
 
 		if len(req.And) == 0 && req.TTH == nil {
@@ -127,14 +132,20 @@ func (c *Client) handleAdcSearchIncomingRequest(id adc.SID, req *adc.SearchReque
 				}
 				return SearchAny
 			}(),
-			minSize: uint64(req.Ge),
-			maxSize: uint64(req.Le),
+			fileOnly:  req.Type == adc.FileTypeFile,
+			minSize:   uint64(req.Ge),
+			maxSize:   uint64(req.Le),
+			exactSize: uint64(req.Eq),
 		}
 
 		if req.TTH != nil {
 			sr.tth = tiger.Hash(*req.TTH)
 		} else {
-			sr.query = req.And[0]
+			sr.terms = req.And
+			sr.notTerms = req.Not
+			sr.exts = req.Ext
+			sr.noExts = req.NoExt
+			sr.group = req.Group
 		}
 
 		return c.handleSearchIncomingRequest(sr)
@@ -198,8 +209,8 @@ func (c *Client) handleAdcSearchIncomingRequest(id adc.SID, req *adc.SearchReque
 		// send to hub
 	} else {
 		for _, msg := range msgs {
-			c.hubConn.conn.Write(&protoadc.AdcDSearchResult{ //nolint:govet
-				&adc.DirectPacket{ID: c.adcSessionID, To: peer.adcSessionID},
+			h.conn.Write(&protoadc.AdcDSearchResult{ //nolint:govet
+				&adc.DirectPacket{ID: h.adcSessionID, To: peer.adcSessionID},
 				msg,
 			})
 		}
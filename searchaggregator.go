@@ -0,0 +1,223 @@
+package dctk
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/aler9/dctk/pkg/tiger"
+)
+
+// SearchAggregatedFile contains the results of a file, grouped by TTH.
+type SearchAggregatedFile struct {
+	// the TTH of the file
+	TTH tiger.Hash
+	// the size of the file
+	Size uint64
+	// the results of the file, one for each peer
+	Results []*SearchResult
+
+	names map[string]int
+}
+
+// Name returns the most common name of the file among results.
+func (f *SearchAggregatedFile) Name() string {
+	best := ""
+	bestCount := 0
+	for _, res := range f.Results {
+		name := path.Base(res.Path)
+		if count := f.names[name]; count > bestCount {
+			best = name
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// peerOf returns the current peer of a result, or nil if the peer is not
+// online anymore. Peers are recreated when they reconnect, therefore they are
+// looked up by nick.
+func (f *SearchAggregatedFile) peerOf(res *SearchResult) *Peer {
+	if res.Peer == nil || res.Peer.Hub == nil || res.Peer.Hub.terminateRequested ||
+		res.Peer.Hub.state != hubInitialized {
+		return nil
+	}
+	return res.Peer.Hub.peerByNick(res.Peer.Nick)
+}
+
+// Peers returns the peers that own the file and are still online.
+// It must be called inside a callback or inside Safe().
+func (f *SearchAggregatedFile) Peers() []*Peer {
+	var ret []*Peer
+	seen := make(map[*Peer]struct{})
+	for _, res := range f.Results {
+		p := f.peerOf(res)
+		if p == nil {
+			continue
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// SlotAvail returns the sum of the available upload slots of the peers
+// that own the file.
+func (f *SearchAggregatedFile) SlotAvail() uint {
+	ret := uint(0)
+	for _, res := range f.Results {
+		ret += res.SlotAvail
+	}
+	return ret
+}
+
+// DownloadConf returns a download configuration that points to the online peer
+// with the most available slots.
+// It must be called inside a callback or inside Safe().
+func (f *SearchAggregatedFile) DownloadConf(savePath string) (DownloadConf, error) {
+	var best *Peer
+	bestSlots := uint(0)
+	for _, res := range f.Results {
+		p := f.peerOf(res)
+		if p == nil {
+			continue
+		}
+		if best == nil || res.SlotAvail > bestSlots {
+			best = p
+			bestSlots = res.SlotAvail
+		}
+	}
+
+	if best == nil {
+		return DownloadConf{}, fmt.Errorf("no peers are online")
+	}
+
+	return DownloadConf{
+		Peer:     best,
+		TTH:      f.TTH,
+		SavePath: savePath,
+	}, nil
+}
+
+// MultiSourceDownloadConf returns a multi-source download configuration that
+// points to all the online peers that own the file.
+// It must be called inside a callback or inside Safe().
+func (f *SearchAggregatedFile) MultiSourceDownloadConf(savePath string) MultiSourceDownloadConf {
+	return MultiSourceDownloadConf{
+		Peers:    f.Peers(),
+		TTH:      f.TTH,
+		Size:     f.Size,
+		SavePath: savePath,
+	}
+}
+
+// SearchAggregatedDirectory contains the results of a directory, grouped by path.
+type SearchAggregatedDirectory struct {
+	// the path of the directory
+	Path string
+	// the biggest size of the directory among results. Sizes of directories
+	// are provided by ADC only
+	Size uint64
+	// the results of the directory, one for each peer
+	Results []*SearchResult
+}
+
+// SearchAggregator groups search results by TTH (files) or by path
+// (directories). It can be filled manually with Add() or obtained from
+// a SearchHandle.
+type SearchAggregator struct {
+	files map[tiger.Hash]*SearchAggregatedFile
+	dirs  map[string]*SearchAggregatedDirectory
+}
+
+// NewSearchAggregator allocates a SearchAggregator.
+func NewSearchAggregator() *SearchAggregator {
+	return &SearchAggregator{
+		files: make(map[tiger.Hash]*SearchAggregatedFile),
+		dirs:  make(map[string]*SearchAggregatedDirectory),
+	}
+}
+
+// Add adds a result. Results of a peer already present in the group are ignored.
+func (a *SearchAggregator) Add(res *SearchResult) {
+	if res.IsDir {
+		d, ok := a.dirs[res.Path]
+		if !ok {
+			d = &SearchAggregatedDirectory{Path: res.Path}
+			a.dirs[res.Path] = d
+		}
+
+		for _, ores := range d.Results {
+			if ores.Peer == res.Peer {
+				return
+			}
+		}
+
+		d.Results = append(d.Results, res)
+		if res.Size > d.Size {
+			d.Size = res.Size
+		}
+		return
+	}
+
+	if res.TTH == nil {
+		return
+	}
+
+	f, ok := a.files[*res.TTH]
+	if !ok {
+		f = &SearchAggregatedFile{
+			TTH:   *res.TTH,
+			Size:  res.Size,
+			names: make(map[string]int),
+		}
+		a.files[*res.TTH] = f
+	}
+
+	for _, ores := range f.Results {
+		if ores.Peer == res.Peer {
+			return
+		}
+	}
+
+	f.Results = append(f.Results, res)
+	f.names[path.Base(res.Path)]++
+}
+
+// File returns the results of a file with the given TTH.
+func (a *SearchAggregator) File(tth tiger.Hash) *SearchAggregatedFile {
+	return a.files[tth]
+}
+
+// Files returns the results of files, sorted by number of peers.
+func (a *SearchAggregator) Files() []*SearchAggregatedFile {
+	ret := make([]*SearchAggregatedFile, 0, len(a.files))
+	for _, f := range a.files {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if len(ret[i].Results) != len(ret[j].Results) {
+			return len(ret[i].Results) > len(ret[j].Results)
+		}
+		return ret[i].TTH.String() < ret[j].TTH.String()
+	})
+	return ret
+}
+
+// Directories returns the results of directories, sorted by number of peers.
+func (a *SearchAggregator) Directories() []*SearchAggregatedDirectory {
+	ret := make([]*SearchAggregatedDirectory, 0, len(a.dirs))
+	for _, d := range a.dirs {
+		ret = append(ret, d)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if len(ret[i].Results) != len(ret[j].Results) {
+			return len(ret[i].Results) > len(ret[j].Results)
+		}
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
@@ -13,8 +13,18 @@ import (
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
-func (c *Client) handleNmdcSearchResult(isActive bool, msg *nmdc.SR) {
-	peer := c.peerByNick(msg.From)
+var searchFileTypeNmdc = map[SearchFileType]nmdc.DataType{
+	SearchFileTypeAny:        nmdc.DataTypeAny,
+	SearchFileTypeAudio:      nmdc.DataTypeAudio,
+	SearchFileTypeCompressed: nmdc.DataTypeCompressed,
+	SearchFileTypeDocument:   nmdc.DataTypeDocument,
+	SearchFileTypeExecutable: nmdc.DataTypeExecutable,
+	SearchFileTypePicture:    nmdc.DataTypePicture,
+	SearchFileTypeVideo:      nmdc.DataTypeVideo,
+}
+
+func (h *Hub) handleNmdcSearchResult(isActive bool, msg *nmdc.SR) {
+	peer := h.peerByNick(msg.From)
 	if peer == nil {
 		return
 	}
@@ -28,19 +38,33 @@ func (c *Client) handleNmdcSearchResult(isActive bool, msg *nmdc.SR) {
 		TTH:       (*tiger.Hash)(msg.TTH),
 		IsDir:     msg.IsDir,
 	}
-	c.handleSearchResult(sr)
+	h.client.handleSearchResult(sr, "")
 }
 
-func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
+// nmdcSearchCheck checks whether a search can be performed with NMDC.
+func nmdcSearchCheck(conf *SearchConf) error {
 	if conf.MaxSize != 0 && conf.MinSize != 0 {
 		return fmt.Errorf("max size and min size cannot be used together in NMDC")
 	}
+	if conf.ExactSize != 0 {
+		return fmt.Errorf("exact size is not supported by NMDC")
+	}
+	if len(conf.ExcludedTerms) > 0 {
+		return fmt.Errorf("excluded terms are not supported by NMDC")
+	}
+	if len(conf.Extensions) > 0 {
+		return fmt.Errorf("extensions are not supported by NMDC")
+	}
+	return nil
+}
 
-	c.hubConn.conn.Write(&nmdc.Search{
+func (h *Hub) handleNmdcSearchOutgoingRequest(conf SearchConf) {
+	c := h.client
+	h.conn.Write(&nmdc.Search{
 		DataType: func() nmdc.DataType {
 			switch conf.Type {
 			case SearchAny:
-				return nmdc.DataTypeAny
+				return searchFileTypeNmdc[conf.FileType]
 			case SearchDirectory:
 				return nmdc.DataTypeFolders
 			}
@@ -56,7 +80,7 @@ func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
 		}(),
 		Pattern: func() string {
 			if conf.Type != SearchTTH {
-				return conf.Query
+				return strings.Join(conf.terms(), " ")
 			}
 			return ""
 		}(),
@@ -75,22 +99,37 @@ func (c *Client) handleNmdcSearchOutgoingRequest(conf SearchConf) error {
 		}(),
 		User: func() string {
 			if c.conf.IsPassive {
-				return c.conf.Nick
+				return h.nick
 			}
 			return ""
 		}(),
 	})
-	return nil
 }
 
-func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
+func (h *Hub) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
+	c := h.client
 	results, err := func() ([]interface{}, error) {
-		// we do not support search by type
-		if _, ok := map[nmdc.DataType]struct{}{
-			nmdc.DataTypeAny:     {},
-			nmdc.DataTypeFolders: {},
-			nmdc.DataTypeTTH:     {},
-		}[req.DataType]; !ok {
+		// passive requests are identified by the author nick, active
+		// requests by the address that receives results
+		source := req.Address
+		if source == "" {
+			source = h.url + " " + req.User
+		}
+		if !c.searchIncomingAllowed(source) {
+			return nil, fmt.Errorf("rate limit of %s exceeded", source)
+		}
+
+		// search by file type
+		fileType, isFileType := func() (SearchFileType, bool) {
+			for ft, dt := range searchFileTypeNmdc {
+				if dt == req.DataType {
+					return ft, true
+				}
+			}
+			return 0, false
+		}()
+
+		if !isFileType && req.DataType != nmdc.DataTypeFolders && req.DataType != nmdc.DataTypeTTH {
 			return nil, fmt.Errorf("unsupported search type: %v", req.DataType)
 		}
 
@@ -98,13 +137,14 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 			isActive: req.Address != "",
 			stype: func() SearchType {
 				switch req.DataType {
-				case nmdc.DataTypeAny:
-					return SearchAny
 				case nmdc.DataTypeFolders:
 					return SearchDirectory
+				case nmdc.DataTypeTTH:
+					return SearchTTH
 				}
-				return SearchTTH
+				return SearchAny
 			}(),
+			group: searchFileTypeAdc[fileType],
 			minSize: func() uint64 {
 				if req.SizeRestricted && !req.IsMaxSize {
 					return req.Size
@@ -122,7 +162,7 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 		if req.DataType == nmdc.DataTypeTTH {
 			sr.tth = tiger.Hash(*req.TTH)
 		} else {
-			sr.query = req.Pattern
+			sr.terms = strings.Fields(req.Pattern)
 		}
 
 		return c.handleSearchIncomingRequest(sr)
@@ -158,10 +198,10 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 				}
 				return nil
 			}(),
-			From:       c.conf.Nick,
+			From:       h.nick,
 			FreeSlots:  int(c.uploadSlotAvail),
 			TotalSlots: int(c.conf.UploadMaxParallel),
-			HubAddress: fmt.Sprintf("%s:%d", c.hubSolvedIP, c.hubPort),
+			HubAddress: fmt.Sprintf("%s:%d", h.solvedIP, h.port),
 		}
 	}
 
@@ -187,7 +227,7 @@ func (c *Client) handleNmdcSearchIncomingRequest(req *nmdc.Search) {
 	} else {
 		for _, msg := range msgs {
 			msg.To = req.User
-			c.hubConn.conn.Write(msg)
+			h.conn.Write(msg)
 		}
 	}
 }
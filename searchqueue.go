@@ -0,0 +1,174 @@
+package dctk
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aler9/dctk/pkg/log"
+	"github.com/aler9/dctk/pkg/protoadc"
+)
+
+// the window in which incoming searches of a source are counted
+const searchIncomingWindow = 1 * time.Minute
+
+// SearchStats contains counters about outgoing and incoming searches.
+type SearchStats struct {
+	// incoming searches that were received
+	IncomingReceived uint64
+	// incoming searches that were answered with at least one result
+	IncomingAnswered uint64
+	// incoming searches that were dropped since their source exceeded
+	// SearchIncomingMaxPerMinute
+	IncomingDropped uint64
+	// outgoing searches that were sent to hubs
+	OutgoingSent uint64
+	// outgoing searches that were merged with an identical queued search
+	OutgoingCoalesced uint64
+	// outgoing searches that are waiting in hub queues
+	OutgoingQueued uint64
+}
+
+// searchQueueItem is an outgoing search request waiting to be sent to a hub.
+// Searches with the same request share the same item and token.
+type searchQueueItem struct {
+	key     string
+	conf    SearchConf
+	token   string
+	handles []*SearchHandle
+}
+
+type searchIncomingSource struct {
+	windowStart time.Time
+	count       uint
+}
+
+// requestKey returns a key that identifies the request sent to hubs.
+func (conf *SearchConf) requestKey() string {
+	return fmt.Sprintf("%d|%d|%d|%d|%q|%q|%d|%q|%s",
+		conf.Type, conf.MinSize, conf.MaxSize, conf.ExactSize, conf.terms(),
+		conf.ExcludedTerms, conf.FileType, conf.Extensions, conf.TTH)
+}
+
+// searchEnqueue adds a search to the outgoing queue of the hub. If an identical
+// search is already queued, the two are merged and a single request is sent.
+func (h *Hub) searchEnqueue(sh *SearchHandle) {
+	c := h.client
+	key := sh.conf.requestKey()
+
+	for _, item := range h.searchQueue {
+		if item.key == key {
+			item.handles = append(item.handles, sh)
+			sh.tokens[h] = item.token
+			c.searchStats.OutgoingCoalesced++
+			log.Log(c.conf.LogLevel, log.LevelDebug, "[search] coalesced with a queued search")
+			return
+		}
+	}
+
+	item := &searchQueueItem{
+		key:     key,
+		conf:    sh.conf,
+		token:   protoadc.AdcRandomToken(),
+		handles: []*SearchHandle{sh},
+	}
+	sh.tokens[h] = item.token
+	h.searchQueue = append(h.searchQueue, item)
+	c.searchStats.OutgoingQueued++
+	h.searchQueueProcess()
+}
+
+// searchQueueProcess sends queued searches, waiting at least SearchMinInterval
+// between them.
+func (h *Hub) searchQueueProcess() {
+	c := h.client
+
+	for len(h.searchQueue) > 0 && h.searchTimer == nil {
+		wait := c.conf.SearchMinInterval - time.Since(h.searchLastSent)
+		if wait > 0 {
+			// the timer may have been stopped and replaced in the meanwhile
+			var t *time.Timer
+			t = time.AfterFunc(wait, func() {
+				c.Safe(func() {
+					if h.terminateRequested || h.searchTimer != t {
+						return
+					}
+					h.searchTimer = nil
+					h.searchQueueProcess()
+				})
+			})
+			h.searchTimer = t
+			return
+		}
+
+		item := h.searchQueue[0]
+		h.searchQueue = h.searchQueue[1:]
+		c.searchStats.OutgoingQueued--
+
+		// skip searches that were closed while waiting
+		open := false
+		for _, sh := range item.handles {
+			if !sh.terminateRequested {
+				open = true
+				break
+			}
+		}
+		if !open {
+			continue
+		}
+
+		h.searchLastSent = time.Now()
+		c.searchStats.OutgoingSent++
+		if h.protoIsAdc() {
+			h.handleAdcSearchOutgoingRequest(item.conf, item.token)
+		} else {
+			h.handleNmdcSearchOutgoingRequest(item.conf)
+		}
+	}
+}
+
+// searchQueueClear drops the queued searches, when the connection with the hub is lost.
+func (h *Hub) searchQueueClear() {
+	h.client.searchStats.OutgoingQueued -= uint64(len(h.searchQueue))
+	h.searchQueue = nil
+	if h.searchTimer != nil {
+		h.searchTimer.Stop()
+		h.searchTimer = nil
+	}
+}
+
+// searchIncomingAllowed checks whether an incoming search can be processed,
+// by counting the searches of its source in a fixed time window.
+func (c *Client) searchIncomingAllowed(source string) bool {
+	c.searchStats.IncomingReceived++
+
+	now := time.Now()
+
+	// remove expired sources
+	if now.Sub(c.searchSourcesPruned) >= searchIncomingWindow {
+		c.searchSourcesPruned = now
+		for key, src := range c.searchSources {
+			if now.Sub(src.windowStart) >= searchIncomingWindow {
+				delete(c.searchSources, key)
+			}
+		}
+	}
+
+	src, ok := c.searchSources[source]
+	if !ok || now.Sub(src.windowStart) >= searchIncomingWindow {
+		src = &searchIncomingSource{windowStart: now}
+		c.searchSources[source] = src
+	}
+
+	if src.count >= c.conf.SearchIncomingMaxPerMinute {
+		c.searchStats.IncomingDropped++
+		return false
+	}
+
+	src.count++
+	return true
+}
+
+// SearchStats returns counters about outgoing and incoming searches.
+func (c *Client) SearchStats() SearchStats {
+	return c.searchStats
+}
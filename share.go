@@ -1,17 +1,32 @@
 package dctk
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dsnet/compress/bzip2"
 
+	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
+const (
+	// delay between a filesystem event and the update of the share
+	shareWatchDelay = 2 * time.Second
+
+	// period of OnShareIndexProgress calls
+	shareIndexProgressPeriod = 1 * time.Second
+)
+
 type shareFile struct {
 	size      uint64
 	modTime   time.Time
@@ -25,7 +40,141 @@ type shareDirectory struct {
 	dirs      map[string]*shareDirectory
 	files     map[string]*shareFile
 	aliasPath string
-	size      uint64
+	realPath  string
+	// the path of the directory with symlinks resolved
+	resolvedPath string
+	size         uint64
+}
+
+// ShareIndexSummary contains the outcome of an indexing of the client share.
+type ShareIndexSummary struct {
+	// the number of indexed files
+	FileCount uint
+	// the total size of indexed files
+	Size uint64
+	// the number of files and directories that were skipped because of errors
+	ErrorCount uint
+	// the aliases of the shared directories that could not be indexed at all
+	FailedRoots []string
+}
+
+// ShareConf allows to configure a shared directory.
+// Partial downloads (files ending with .tmp) and files that are not regular
+// (sockets, devices, pipes) are never shared.
+type ShareConf struct {
+	// if filled, only files whose name matches at least one of these glob
+	// patterns or regular expressions are shared. Regular expressions are
+	// matched against the path relative to the shared directory, with slashes
+	// as separators
+	Include       []string
+	IncludeRegexp []*regexp.Regexp
+	// files and directories whose name matches at least one of these glob
+	// patterns or regular expressions are not shared. Regular expressions are
+	// matched against the path relative to the shared directory, with slashes
+	// as separators
+	Exclude       []string
+	ExcludeRegexp []*regexp.Regexp
+	// do not share files and directories whose name starts with a dot
+	SkipHidden bool
+	// do not share files smaller than this size
+	MinSize uint64
+	// do not share files bigger than this size. It defaults to zero, that means no limit
+	MaxSize uint64
+	// do not follow symbolic links. By default, symbolic links are followed,
+	// with the exception of the ones that produce loops
+	SkipSymlinks bool
+}
+
+type shareRoot struct {
+	path string
+	conf ShareConf
+}
+
+// shares checks whether a file or directory must be shared. The size is
+// ignored for directories. This is applied both when scanning directories and
+// when publishing the tree, in order to apply the configuration to entries
+// reused from a previous scan too.
+func (r *shareRoot) shares(fpath string, name string, isDir bool, size uint64) bool {
+	if !isDir && strings.HasSuffix(name, ".tmp") {
+		return false
+	}
+
+	if !isDir && (size < r.conf.MinSize || (r.conf.MaxSize != 0 && size > r.conf.MaxSize)) {
+		return false
+	}
+
+	if r.conf.SkipHidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	rel, _ := filepath.Rel(r.path, fpath)
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range r.conf.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	for _, re := range r.conf.ExcludeRegexp {
+		if re.MatchString(rel) {
+			return false
+		}
+	}
+
+	// include lists are applied to files only
+	if isDir || (len(r.conf.Include) == 0 && len(r.conf.IncludeRegexp) == 0) {
+		return true
+	}
+
+	for _, pattern := range r.conf.Include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	for _, re := range r.conf.IncludeRegexp {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+type shareHashJob struct {
+	dir   *shareDirectory
+	name  string
+	file  *shareFile
+	finfo os.FileInfo
+	tthl  tiger.Leaves
+	err   error
+}
+
+// shareScan contains the outcome of a scan of directories.
+type shareScan struct {
+	errors []shareIndexError
+	jobs   []*shareHashJob
+}
+
+// shareHashReader is a Reader that counts and limits the read bytes.
+type shareHashReader struct {
+	r         io.Reader
+	limiter   *rateLimiter
+	bytesDone *uint64
+}
+
+func (r *shareHashReader) Read(p []byte) (int, error) {
+	// read in small chunks in order to limit bandwidth smoothly
+	if len(p) > rateLimiterChunkSize {
+		p = p[:rateLimiterChunkSize]
+	}
+	n, err := r.r.Read(p)
+	atomic.AddUint64(r.bytesDone, uint64(n))
+	r.limiter.wait(n)
+	return n, err
+}
+
+type shareIndexError struct {
+	path string
+	err  error
 }
 
 type shareIndexer struct {
@@ -34,16 +183,36 @@ type shareIndexer struct {
 	terminate          chan struct{}
 	indexChan          chan struct{}
 	indexRequested     bool
+	watcher            *shareWatcher
+	watchChan          chan string
+	limiter            *rateLimiter
 }
 
 func newshareIndexer(client *Client) error {
 	client.shareIndexer = &shareIndexer{
-		client: client,
-		// must be buffered since it could otherwise cause a deadlock:
-		// - after <-indexChan and before Safe()
+		client:    client,
 		terminate: make(chan struct{}),
-		indexChan: make(chan struct{}),
+		indexChan: make(chan struct{}, 1),
+		watchChan: make(chan string),
+		limiter:   newRateLimiter(client.conf.ShareHashMaxSpeed),
+	}
+
+	if client.conf.ShareCacheDir != "" {
+		var err error
+		client.hashCache, err = newHashCache(client.conf.ShareCacheDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if client.conf.ShareWatch {
+		var err error
+		client.shareIndexer.watcher, err = newShareWatcher(client.shareIndexer)
+		if err != nil {
+			return err
+		}
 	}
+
 	client.shareIndexer.index()
 	return nil
 }
@@ -54,131 +223,457 @@ func (sm *shareIndexer) close() {
 	}
 	sm.terminateRequested = true
 	close(sm.terminate)
+	if sm.watcher != nil {
+		sm.watcher.close()
+	}
 }
 
 func (sm *shareIndexer) do() {
 	defer sm.client.wg.Done()
 
+	// changes are applied after a delay, in order to group bursts of events
+	changedDirs := make(map[string]struct{})
+	fullIndex := false
+	watchTimer := time.NewTimer(0)
+	<-watchTimer.C
+	defer watchTimer.Stop()
+
 	for {
 		select {
 		case <-sm.terminate:
 			return
+
 		case <-sm.indexChan:
+			sm.index()
+
+		case dpath := <-sm.watchChan:
+			// an empty path means that events were lost
+			if dpath == "" {
+				fullIndex = true
+			} else {
+				changedDirs[dpath] = struct{}{}
+			}
+			if !watchTimer.Stop() {
+				select {
+				case <-watchTimer.C:
+				default:
+				}
+			}
+			watchTimer.Reset(shareWatchDelay)
+
+		case <-watchTimer.C:
+			if fullIndex {
+				sm.index()
+			} else {
+				sm.update(changedDirs)
+			}
+			changedDirs = make(map[string]struct{})
+			fullIndex = false
 		}
+	}
+}
 
-		sm.index()
+// scanTopDir scans a directory that is not reached through the scan of its parent.
+func (sm *shareIndexer) scanTopDir(root *shareRoot, apath string, dpath string, oldDir *shareDirectory,
+	deep bool, scan *shareScan, visited map[string]struct{}) (*shareDirectory, error) {
+	rpath, err := filepath.EvalSymlinks(dpath)
+	if err != nil {
+		return nil, err
 	}
+	return sm.scanDir(root, apath, dpath, rpath, oldDir, deep, scan, visited)
 }
 
-func (sm *shareIndexer) index() {
-	copyRoots := make(map[string]string)
-	sm.client.Safe(func() {
-		sm.indexRequested = false
+// scanDir scans a directory. If deep is false, subdirectories that are
+// already present in oldDir are not scanned again. rpath is the path of the
+// directory with symlinks resolved, and visited contains the resolved paths of
+// the directories scanned so far, in order to scan every directory once.
+func (sm *shareIndexer) scanDir(root *shareRoot, apath string, dpath string, rpath string,
+	oldDir *shareDirectory, deep bool, scan *shareScan, visited map[string]struct{},
+) (*shareDirectory, error) {
+	visited[rpath] = struct{}{}
+
+	dir := &shareDirectory{
+		dirs:         make(map[string]*shareDirectory),
+		files:        make(map[string]*shareFile),
+		aliasPath:    apath,
+		realPath:     dpath,
+		resolvedPath: rpath,
+	}
+
+	files, err := os.ReadDir(dpath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		fpath := filepath.Join(dpath, file.Name())
+		frpath := filepath.Join(rpath, file.Name())
+		isDir := file.IsDir()
+		var finfo os.FileInfo
+
+		if file.Type()&os.ModeSymlink != 0 {
+			if root.conf.SkipSymlinks {
+				continue
+			}
 
-		// create a copy of shareRoots
+			// get info of the symlink target
+			finfo, err = os.Stat(fpath)
+			if err != nil {
+				// errors of single entries are collected and the entries are skipped
+				scan.errors = append(scan.errors, shareIndexError{fpath, err})
+				continue
+			}
+			isDir = finfo.IsDir()
+
+			// a symlink that points to the directory that contains it, or to
+			// one of its parents, would produce an infinite tree
+			if isDir && root.shares(fpath, file.Name(), true, 0) {
+				frpath, err = filepath.EvalSymlinks(fpath)
+				if err != nil {
+					scan.errors = append(scan.errors, shareIndexError{fpath, err})
+					continue
+				}
+				if shareSymlinkIsLoop(rpath, frpath) {
+					scan.errors = append(scan.errors, shareIndexError{fpath, fmt.Errorf("symlink loop")})
+					continue
+				}
+			}
+		}
+
+		if isDir {
+			if !root.shares(fpath, file.Name(), true, 0) {
+				continue
+			}
+
+			// directories reachable through multiple symlinks are shared once,
+			// otherwise symlinks that point to each other would produce an
+			// infinite tree
+			if _, ok := visited[frpath]; ok {
+				scan.errors = append(scan.errors, shareIndexError{fpath, fmt.Errorf("directory already shared")})
+				continue
+			}
+
+			var subOldDir *shareDirectory
+			if oldDir != nil {
+				subOldDir = oldDir.dirs[file.Name()]
+			}
+
+			if !deep && subOldDir != nil {
+				shareDirectoryVisit(subOldDir, nil, visited)
+				dir.dirs[file.Name()] = subOldDir
+				continue
+			}
+
+			subdir, err := sm.scanDir(root, filepath.Join(apath, file.Name()), fpath, frpath,
+				subOldDir, true, scan, visited)
+			if err != nil {
+				scan.errors = append(scan.errors, shareIndexError{fpath, err})
+				continue
+			}
+			dir.dirs[file.Name()] = subdir
+		} else {
+			if finfo == nil {
+				finfo, err = file.Info()
+				if err != nil {
+					scan.errors = append(scan.errors, shareIndexError{fpath, err})
+					continue
+				}
+			}
+
+			// skip sockets, devices, pipes
+			if !finfo.Mode().IsRegular() {
+				continue
+			}
+
+			if !root.shares(fpath, file.Name(), false, uint64(finfo.Size())) {
+				continue
+			}
+
+			var oldFile *shareFile
+			if oldDir != nil {
+				oldFile = oldDir.files[file.Name()]
+			}
+
+			sfile, job, err := sm.indexFile(filepath.Join(apath, file.Name()), fpath, finfo, oldFile)
+			if err != nil {
+				scan.errors = append(scan.errors, shareIndexError{fpath, err})
+				continue
+			}
+
+			dir.files[file.Name()] = sfile
+			dir.size += sfile.size
+
+			// file is hashed later
+			if job != nil {
+				job.dir = dir
+				job.name = file.Name()
+				scan.jobs = append(scan.jobs, job)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// shareSymlinkIsLoop checks whether a symlink inside a directory points to
+// the directory or to one of its parents. Both paths must have symlinks resolved.
+func shareSymlinkIsLoop(realDir string, target string) bool {
+	return realDir == target || strings.HasPrefix(realDir, target+string(filepath.Separator)) ||
+		target == string(filepath.Separator)
+}
+
+// shareDirectoryVisit adds the resolved paths of a directory and of its
+// subdirectories to visited, with the exception of skip and its subdirectories.
+func shareDirectoryVisit(dir *shareDirectory, skip *shareDirectory, visited map[string]struct{}) {
+	if dir == skip {
+		return
+	}
+	visited[dir.resolvedPath] = struct{}{}
+	for _, sdir := range dir.dirs {
+		shareDirectoryVisit(sdir, skip, visited)
+	}
+}
+
+// shareDirectoryFilter removes from a directory the files and subdirectories
+// that are not shared according to the configuration of the root. The
+// directory is copied only when entries are removed, in order not to modify
+// the tree in use.
+func shareDirectoryFilter(root *shareRoot, alias string, dir *shareDirectory) *shareDirectory {
+	ndir := dir
+	edit := func() {
+		if ndir == dir {
+			ndir = shareDirectoryCopy(dir)
+		}
+	}
+	fpathOf := func(aliasPath string) string {
+		return filepath.Join(root.path, strings.TrimPrefix(aliasPath, "/"+alias))
+	}
+
+	for name, sdir := range dir.dirs {
+		if !root.shares(fpathOf(sdir.aliasPath), name, true, 0) {
+			edit()
+			delete(ndir.dirs, name)
+			continue
+		}
+		if fdir := shareDirectoryFilter(root, alias, sdir); fdir != sdir {
+			edit()
+			ndir.dirs[name] = fdir
+		}
+	}
+
+	for name, file := range dir.files {
+		if !root.shares(fpathOf(file.aliasPath), name, false, file.size) {
+			edit()
+			delete(ndir.files, name)
+			ndir.size -= file.size
+		}
+	}
+	return ndir
+}
+
+func (sm *shareIndexer) copyRoots() map[string]*shareRoot {
+	copyRoots := make(map[string]*shareRoot)
+	sm.client.Safe(func() {
 		for k, v := range sm.client.shareRoots {
 			copyRoots[k] = v
 		}
 	})
+	return copyRoots
+}
+
+func (sm *shareIndexer) index() {
+	sm.client.Safe(func() {
+		sm.indexRequested = false
+	})
+	copyRoots := sm.copyRoots()
+
+	hc := sm.client.hashCache
+	if hc != nil {
+		if err := hc.begin(); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelInfo, "[share] unable to open hash cache: %s", err)
+		}
+	}
 
 	// generate new tree
-	shareTree, shareCount, shareSize := func() (map[string]*shareDirectory, uint, uint64) {
-		tree := make(map[string]*shareDirectory)
-		count := uint(0)
-		size := uint64(0)
-		var scanDir func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error)
-		scanDir = func(apath string, dpath string, oldDir *shareDirectory) (*shareDirectory, error) {
-			dir := &shareDirectory{
-				dirs:      make(map[string]*shareDirectory),
-				files:     make(map[string]*shareFile),
-				aliasPath: apath,
-			}
-
-			files, err := os.ReadDir(dpath)
-			if err != nil {
-				return nil, err
-			}
-			for _, file := range files {
-				if file.IsDir() {
-					subOldDir := func() *shareDirectory {
-						if oldDir == nil {
-							return nil
-						}
-						return oldDir.dirs[file.Name()]
-					}()
-					subdir, err := scanDir(filepath.Join(apath, file.Name()), filepath.Join(dpath, file.Name()), subOldDir)
-					if err != nil {
-						return nil, err
-					}
-					dir.dirs[file.Name()] = subdir
-				} else {
-					var tthl tiger.Leaves
-					var tth tiger.Hash
-
-					aliasPath := filepath.Join(apath, file.Name())
-					origPath := filepath.Join(dpath, file.Name())
-
-					// solve symlinks
-					realPath, err := filepath.EvalSymlinks(origPath)
-					if err != nil {
-						return nil, err
-					}
-
-					// get real file info
-					var finfo os.FileInfo
-					finfo, err = os.Stat(realPath)
-					if err != nil {
-						return nil, err
-					}
-
-					fileSize := uint64(finfo.Size())
-					fileModTime := finfo.ModTime()
-
-					// recover tth if size and mtime are the same
-					if oldDir != nil && oldDir.files[file.Name()] != nil &&
-						fileSize == oldDir.files[file.Name()].size &&
-						fileModTime.Equal(oldDir.files[file.Name()].modTime) {
-						tth = oldDir.files[file.Name()].tth
-					} else {
-						var err error
-						tthl, err = tiger.LeavesFromFile(realPath)
-						if err != nil {
-							return nil, err
-						}
-
-						tth = tthl.TreeHash()
-					}
-
-					dir.files[file.Name()] = &shareFile{
-						size:      fileSize,
-						modTime:   fileModTime,
-						tthl:      tthl,
-						tth:       tth,
-						aliasPath: aliasPath,
-						realPath:  realPath,
-					}
-					dir.size += fileSize
-					count++
-					size += fileSize
-				}
-			}
-			return dir, nil
+	scan := &shareScan{}
+	shareTree := make(map[string]*shareDirectory)
+	for alias, root := range copyRoots {
+		rdir, err := sm.scanTopDir(root, "/"+alias, root.path, sm.client.shareTree[alias], true, scan,
+			make(map[string]struct{}))
+		if err != nil {
+			// a root error affects its alias only
+			scan.errors = append(scan.errors, shareIndexError{root.path, err})
+			continue
+		}
+		shareTree[alias] = rdir
+	}
+
+	sm.hashFiles(scan)
+
+	if hc != nil {
+		if err := hc.end(); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelInfo, "[share] unable to save hash cache: %s", err)
+		}
+	}
+
+	sm.publish(copyRoots, shareTree, scan.errors)
+}
+
+// update rescans the directories that were reported as changed by the watcher.
+// Unchanged files and subdirectories are taken from the current tree, that
+// is copied along the path of every changed directory, in order not to modify
+// the tree in use.
+func (sm *shareIndexer) update(changedDirs map[string]struct{}) {
+	copyRoots := sm.copyRoots()
+
+	hc := sm.client.hashCache
+	if hc != nil {
+		if err := hc.begin(); err != nil {
+			log.Log(sm.client.conf.LogLevel, log.LevelInfo, "[share] unable to open hash cache: %s", err)
 		}
+	}
+
+	scan := &shareScan{}
+	shareTree := make(map[string]*shareDirectory)
+	for alias, dir := range sm.client.shareTree {
+		shareTree[alias] = dir
+	}
+
+	for dpath := range changedDirs {
 		for alias, root := range copyRoots {
-			oldDir := func() *shareDirectory {
-				if t, ok := sm.client.shareTree[alias]; ok {
-					return t
+			rel, err := filepath.Rel(root.path, dpath)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+
+			// root
+			if rel == "." {
+				rdir, err := sm.scanTopDir(root, "/"+alias, root.path, shareTree[alias], false, scan,
+					make(map[string]struct{}))
+				if err != nil {
+					scan.errors = append(scan.errors, shareIndexError{root.path, err})
+					delete(shareTree, alias)
+					continue
+				}
+				shareTree[alias] = rdir
+				continue
+			}
+
+			if shareTree[alias] == nil {
+				continue
+			}
+
+			parent := shareDirectoryCopy(shareTree[alias])
+			shareTree[alias] = parent
+			parts := strings.Split(rel, string(filepath.Separator))
+
+			for _, part := range parts[:len(parts)-1] {
+				sdir, ok := parent.dirs[part]
+				if !ok {
+					parent = nil
+					break
 				}
-				return nil
-			}()
-			rdir, err := scanDir("/"+alias, root, oldDir)
+				sdir = shareDirectoryCopy(sdir)
+				parent.dirs[part] = sdir
+				parent = sdir
+			}
+
+			// the directory is not in the tree, and will be scanned
+			// with its parent
+			name := parts[len(parts)-1]
+			if parent == nil || parent.dirs[name] == nil {
+				continue
+			}
+
+			// directories outside of the rescanned one are already shared
+			visited := make(map[string]struct{})
+			shareDirectoryVisit(shareTree[alias], parent.dirs[name], visited)
+
+			dir, err := sm.scanTopDir(root, filepath.Join(parent.aliasPath, name), dpath, parent.dirs[name], false,
+				scan, visited)
 			if err != nil {
-				panic(err)
+				// the directory was removed
+				delete(parent.dirs, name)
+				continue
 			}
-			tree[alias] = rdir
+			parent.dirs[name] = dir
 		}
-		return tree, count, size
-	}()
+	}
+
+	sm.hashFiles(scan)
+
+	if hc != nil {
+		hc.flush()
+	}
+
+	sm.publish(copyRoots, shareTree, scan.errors)
+}
+
+func shareDirectoryCopy(dir *shareDirectory) *shareDirectory {
+	ndir := &shareDirectory{
+		dirs:         make(map[string]*shareDirectory),
+		files:        make(map[string]*shareFile),
+		aliasPath:    dir.aliasPath,
+		realPath:     dir.realPath,
+		resolvedPath: dir.resolvedPath,
+		size:         dir.size,
+	}
+	for name, sdir := range dir.dirs {
+		ndir.dirs[name] = sdir
+	}
+	for name, file := range dir.files {
+		ndir.files[name] = file
+	}
+	return ndir
+}
+
+// publish generates the file list of a tree, replaces the current tree
+// and informs hubs.
+func (sm *shareIndexer) publish(copyRoots map[string]*shareRoot,
+	shareTree map[string]*shareDirectory, indexErrors []shareIndexError) {
+	var shareCount uint
+	var shareSize uint64
+	var dirPaths []string
+	shareByTTH := make(map[tiger.Hash][]*shareFile)
+
+	// entries that are reused from previous scans were filtered with the
+	// configuration in use at that time
+	for alias, dir := range shareTree {
+		root, ok := copyRoots[alias]
+		if !ok {
+			delete(shareTree, alias)
+			continue
+		}
+		shareTree[alias] = shareDirectoryFilter(root, alias, dir)
+	}
+
+	var countDir func(dir *shareDirectory)
+	countDir = func(dir *shareDirectory) {
+		shareCount += uint(len(dir.files))
+		shareSize += dir.size
+		dirPaths = append(dirPaths, dir.realPath)
+		for _, file := range dir.files {
+			shareByTTH[file.tth] = append(shareByTTH[file.tth], file)
+		}
+		for _, sdir := range dir.dirs {
+			countDir(sdir)
+		}
+	}
+	for _, dir := range shareTree {
+		countDir(dir)
+	}
+
+	var failedRoots []string
+	for alias := range copyRoots {
+		if _, ok := shareTree[alias]; !ok {
+			failedRoots = append(failedRoots, alias)
+		}
+	}
+	sort.Strings(failedRoots)
+
+	shareIndex := newShareNameIndex(shareTree)
+
+	if sm.watcher != nil {
+		sm.watcher.sync(dirPaths)
+	}
 
 	// generate new file list
 	fileList, err := func() ([]byte, error) {
@@ -237,33 +732,206 @@ func (sm *shareIndexer) index() {
 	sm.client.Safe(func() {
 		// override atomically
 		sm.client.shareTree = shareTree
+		sm.client.shareByTTH = shareByTTH
+		sm.client.shareIndex = shareIndex
 		sm.client.fileList = fileList
 		sm.client.shareCount = shareCount
 		sm.client.shareSize = shareSize
 
-		// inform hub
-		if !sm.client.hubConn.terminateRequested && sm.client.hubConn.state == hubInitialized {
-			sm.client.sendInfos(false)
+		// inform hubs
+		for _, h := range sm.client.hubs {
+			if !h.terminateRequested && h.state == hubInitialized {
+				h.sendInfos(false)
+			}
+		}
+
+		for _, ie := range indexErrors {
+			log.Log(sm.client.conf.LogLevel, log.LevelInfo, "[share] unable to index %s: %s", ie.path, ie.err)
+			if sm.client.OnShareIndexError != nil {
+				sm.client.OnShareIndexError(ie.path, ie.err)
+			}
 		}
 
 		if sm.client.OnShareIndexed != nil {
-			sm.client.OnShareIndexed()
+			sm.client.OnShareIndexed(ShareIndexSummary{
+				FileCount:   shareCount,
+				Size:        shareSize,
+				ErrorCount:  uint(len(indexErrors)),
+				FailedRoots: failedRoots,
+			})
 		}
 	})
 }
 
+// indexFile returns the entry of a file. If the file hash is not available,
+// a hashing job is returned too.
+func (sm *shareIndexer) indexFile(aliasPath string, origPath string, finfo os.FileInfo,
+	oldFile *shareFile) (*shareFile, *shareHashJob, error) {
+	// solve symlinks
+	realPath, err := filepath.EvalSymlinks(origPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sfile := &shareFile{
+		size:      uint64(finfo.Size()),
+		modTime:   finfo.ModTime(),
+		aliasPath: aliasPath,
+		realPath:  realPath,
+	}
+
+	// use the hash cache. Leaves are saved on disk
+	if hc := sm.client.hashCache; hc != nil {
+		if tth, ok := hc.get(realPath, finfo); ok {
+			sfile.tth = tth
+			return sfile, nil, nil
+		}
+
+		// recover tth if size and mtime are the same
+	} else if oldFile != nil && sfile.size == oldFile.size && sfile.modTime.Equal(oldFile.modTime) {
+		sfile.tth = oldFile.tth
+		sfile.tthl = oldFile.tthl
+		return sfile, nil, nil
+	}
+
+	return sfile, &shareHashJob{file: sfile, finfo: finfo}, nil
+}
+
+// hashFiles hashes the files of a scan in parallel, and removes from the tree
+// the files that can't be hashed.
+func (sm *shareIndexer) hashFiles(scan *shareScan) {
+	if len(scan.jobs) == 0 {
+		return
+	}
+
+	filesTotal := uint(len(scan.jobs))
+	bytesTotal := uint64(0)
+	for _, job := range scan.jobs {
+		bytesTotal += job.file.size
+	}
+
+	filesDone := uint(0)
+	bytesDone := uint64(0)
+
+	progress := func() {
+		sm.client.Safe(func() {
+			if sm.client.OnShareIndexProgress != nil {
+				sm.client.OnShareIndexProgress(filesDone, filesTotal,
+					atomic.LoadUint64(&bytesDone), bytesTotal)
+			}
+		})
+	}
+
+	jobChan := make(chan *shareHashJob)
+	doneChan := make(chan *shareHashJob)
+
+	go func() {
+		for _, job := range scan.jobs {
+			jobChan <- job
+		}
+		close(jobChan)
+	}()
+
+	for i := uint(0); i < sm.client.conf.ShareHashWorkers; i++ {
+		go func() {
+			for job := range jobChan {
+				job.tthl, job.err = sm.hashFile(job.file.realPath, &bytesDone)
+				doneChan <- job
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(shareIndexProgressPeriod)
+	defer ticker.Stop()
+
+	for filesDone < filesTotal {
+		select {
+		case job := <-doneChan:
+			filesDone++
+
+			if job.err == nil {
+				job.file.tth = job.tthl.TreeHash()
+				job.file.tthl = job.tthl
+
+				if hc := sm.client.hashCache; hc != nil {
+					job.err = hc.set(job.file.realPath, job.finfo, job.tthl)
+					job.file.tthl = nil
+				}
+			}
+
+			if job.err != nil {
+				scan.errors = append(scan.errors, shareIndexError{job.file.realPath, job.err})
+				delete(job.dir.files, job.name)
+				job.dir.size -= job.file.size
+			}
+
+			if filesDone == filesTotal {
+				progress()
+			}
+
+		case <-ticker.C:
+			progress()
+		}
+	}
+}
+
+func (sm *shareIndexer) hashFile(fpath string, bytesDone *uint64) (tiger.Leaves, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &shareHashReader{
+		r:         f,
+		limiter:   sm.limiter,
+		bytesDone: bytesDone,
+	}
+
+	// buffer to optimize disk read
+	return tiger.LeavesFromReader(bufio.NewReaderSize(r, 1024*1024))
+}
+
+// shareFileByTTH returns a shared file with the given TTH, if any.
+func (c *Client) shareFileByTTH(tth tiger.Hash) *shareFile {
+	if files, ok := c.shareByTTH[tth]; ok {
+		return files[0]
+	}
+	return nil
+}
+
 // ShareAdd adds a given directory (dpath) to the client share, with the given
 // alias, and starts indexing its subdirectories and files.
 // if a directory with the same alias was added previously, it is replaced with
 // the new one. OnShareIndexed is called when the indexing is finished.
-func (c *Client) ShareAdd(alias string, dpath string) {
-	c.shareRoots[alias] = dpath
+// Files and directories that can't be read are skipped and reported through
+// OnShareIndexError. An optional ShareConf can be provided in order to
+// choose which files are shared.
+func (c *Client) ShareAdd(alias string, dpath string, conf ...ShareConf) error {
+	root := &shareRoot{path: dpath}
+	if len(conf) > 0 {
+		root.conf = conf[0]
+	}
+
+	for _, pattern := range append(root.conf.Include, root.conf.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %s", pattern, err)
+		}
+	}
+
+	c.shareRoots[alias] = root
 
 	// always schedule indexing
 	if !c.shareIndexer.indexRequested {
 		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+
+		// the indexer may be waiting for the mutex, therefore do not block
+		select {
+		case c.shareIndexer.indexChan <- struct{}{}:
+		default:
+		}
 	}
+	return nil
 }
 
 // ShareDel removes a directory with the given alias from the client share, and
@@ -278,6 +946,11 @@ func (c *Client) ShareDel(alias string) {
 	// always schedule indexing
 	if !c.shareIndexer.indexRequested {
 		c.shareIndexer.indexRequested = true
-		c.shareIndexer.indexChan <- struct{}{}
+
+		// the indexer may be waiting for the mutex, therefore do not block
+		select {
+		case c.shareIndexer.indexChan <- struct{}{}:
+		default:
+		}
 	}
 }
@@ -0,0 +1,206 @@
+package dctk
+
+import (
+	"sort"
+	"strings"
+)
+
+// shareNameIndex is an index of the names of shared files and directories,
+// that allows to find them by substring without scanning the whole share.
+// Names are split into trigrams, that point to the nodes containing them.
+// Nodes are stored in depth-first order, therefore the descendants of a
+// directory are the nodes between the directory and its end.
+// A node matches a term when the term is contained in the name of the node
+// or in the name of one of its parent directories.
+type shareNameIndex struct {
+	nodes    []shareNameNode
+	trigrams map[uint32][]int32
+}
+
+type shareNameNode struct {
+	name   string // lowercase
+	parent int32
+	end    int32
+	dir    *shareDirectory
+	file   *shareFile
+}
+
+type shareNameInterval struct {
+	start int32
+	end   int32
+}
+
+func shareNameTrigram(s string) uint32 {
+	return uint32(s[0])<<16 | uint32(s[1])<<8 | uint32(s[2])
+}
+
+func newShareNameIndex(tree map[string]*shareDirectory) *shareNameIndex {
+	idx := &shareNameIndex{
+		trigrams: make(map[uint32][]int32),
+	}
+
+	var addDir func(name string, parent int32, dir *shareDirectory)
+	addDir = func(name string, parent int32, dir *shareDirectory) {
+		id := idx.add(name, parent, dir, nil)
+		for fname, file := range dir.files {
+			idx.add(fname, id, nil, file)
+		}
+		for sname, sdir := range dir.dirs {
+			addDir(sname, id, sdir)
+		}
+		idx.nodes[id].end = int32(len(idx.nodes))
+	}
+	for alias, dir := range tree {
+		addDir(alias, -1, dir)
+	}
+
+	return idx
+}
+
+func (idx *shareNameIndex) add(name string, parent int32, dir *shareDirectory, file *shareFile) int32 {
+	id := int32(len(idx.nodes))
+	name = strings.ToLower(name)
+	idx.nodes = append(idx.nodes, shareNameNode{
+		name:   name,
+		parent: parent,
+		end:    id + 1,
+		dir:    dir,
+		file:   file,
+	})
+
+	for i := 0; i+3 <= len(name); i++ {
+		t := shareNameTrigram(name[i:])
+		ids := idx.trigrams[t]
+		// a trigram can be repeated inside a name
+		if len(ids) == 0 || ids[len(ids)-1] != id {
+			idx.trigrams[t] = append(ids, id)
+		}
+	}
+
+	return id
+}
+
+// termCost returns an estimate of the nodes that must be checked in order to
+// search a lowercase term, that must be at least 3 bytes long.
+func (idx *shareNameIndex) termCost(term string) int {
+	cost := -1
+	for i := 0; i+3 <= len(term); i++ {
+		n := len(idx.trigrams[shareNameTrigram(term[i:])])
+		if cost < 0 || n < cost {
+			cost = n
+		}
+	}
+	return cost
+}
+
+// termIntervals returns the nodes that match a lowercase term, that must be
+// at least 3 bytes long.
+func (idx *shareNameIndex) termIntervals(term string) []shareNameInterval {
+	var lists [][]int32
+	for i := 0; i+3 <= len(term); i++ {
+		ids, ok := idx.trigrams[shareNameTrigram(term[i:])]
+		if !ok {
+			return nil
+		}
+		lists = append(lists, ids)
+	}
+
+	// intersect lists, starting from the shortest
+	sort.Slice(lists, func(i, j int) bool {
+		return len(lists[i]) < len(lists[j])
+	})
+	ids := lists[0]
+	for _, l := range lists[1:] {
+		ids = shareNameIntersectIDs(ids, l)
+	}
+
+	var ret []shareNameInterval
+	for _, id := range ids {
+		// trigrams can be found in a name even if the term is not
+		n := &idx.nodes[id]
+		if !strings.Contains(n.name, term) {
+			continue
+		}
+
+		// skip descendants of a node already added
+		if len(ret) > 0 && id < ret[len(ret)-1].end {
+			continue
+		}
+
+		ret = append(ret, shareNameInterval{id, n.end})
+	}
+	return ret
+}
+
+// shareNameIntersectIDs intersects two sorted lists. The first list must be
+// the shortest.
+func shareNameIntersectIDs(a []int32, b []int32) []int32 {
+	var ret []int32
+	for _, id := range a {
+		i := sort.Search(len(b), func(i int) bool {
+			return b[i] >= id
+		})
+		if i < len(b) && b[i] == id {
+			ret = append(ret, id)
+		}
+		b = b[i:]
+	}
+	return ret
+}
+
+// matches checks whether a node matches a lowercase term.
+func (idx *shareNameIndex) matches(id int32, term string) bool {
+	for ; id >= 0; id = idx.nodes[id].parent {
+		if strings.Contains(idx.nodes[id].name, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// search calls cb for every node that matches all the given lowercase terms,
+// and none of the given lowercase excluded terms. The search stops when cb
+// returns false.
+func (idx *shareNameIndex) search(terms []string, notTerms []string, cb func(n *shareNameNode) bool) {
+	// nodes are found through the term that is supposed to be the rarest,
+	// and are checked against the other terms
+	first := -1
+	firstCost := 0
+	for i, term := range terms {
+		if len(term) < 3 {
+			continue
+		}
+		cost := idx.termCost(term)
+		if first < 0 || cost < firstCost {
+			first = i
+			firstCost = cost
+		}
+	}
+
+	// terms shorter than 3 bytes can't be found through trigrams, therefore
+	// when all terms are short, all nodes are checked
+	intervals := []shareNameInterval{{0, int32(len(idx.nodes))}}
+	if first >= 0 {
+		intervals = idx.termIntervals(terms[first])
+	}
+
+	for _, iv := range intervals {
+	outer:
+		for id := iv.start; id < iv.end; id++ {
+			for i, term := range terms {
+				if i != first && !idx.matches(id, term) {
+					continue outer
+				}
+			}
+			for _, term := range notTerms {
+				if idx.matches(id, term) {
+					continue outer
+				}
+			}
+
+			if !cb(&idx.nodes[id]) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package dctk
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+const shareWatcherMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// shareWatcher watches shared directories through inotify, and sends the
+// directories whose content changed to the share indexer.
+type shareWatcher struct {
+	sm      *shareIndexer
+	fd      int
+	file    *os.File
+	mutex   sync.Mutex
+	watches map[int32]map[string]struct{}
+	paths   map[string]int32
+}
+
+func newShareWatcher(sm *shareIndexer) (*shareWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shareWatcher{
+		sm: sm,
+		fd: fd,
+		// since the descriptor is non-blocking, reads can be interrupted by Close()
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]map[string]struct{}),
+		paths:   make(map[string]int32),
+	}, nil
+}
+
+func (w *shareWatcher) close() {
+	w.file.Close()
+}
+
+func (w *shareWatcher) do() {
+	defer w.sm.client.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			var dpaths []string
+			switch {
+			// events were lost, the whole share must be indexed again
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				dpaths = []string{""}
+
+			// watch was removed
+			case ev.Mask&syscall.IN_IGNORED != 0:
+				w.mutex.Lock()
+				for p := range w.watches[ev.Wd] {
+					delete(w.paths, p)
+				}
+				delete(w.watches, ev.Wd)
+				w.mutex.Unlock()
+				continue
+
+			// a directory can be reachable through multiple paths
+			default:
+				w.mutex.Lock()
+				for p := range w.watches[ev.Wd] {
+					dpaths = append(dpaths, p)
+				}
+				w.mutex.Unlock()
+			}
+
+			for _, dpath := range dpaths {
+				select {
+				case w.sm.watchChan <- dpath:
+				case <-w.sm.terminate:
+					return
+				}
+			}
+		}
+	}
+}
+
+// sync sets the watched directories.
+func (w *shareWatcher) sync(dpaths []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	cur := make(map[string]struct{})
+	for _, dpath := range dpaths {
+		cur[dpath] = struct{}{}
+	}
+
+	for dpath, wd := range w.paths {
+		if _, ok := cur[dpath]; !ok {
+			delete(w.paths, dpath)
+			delete(w.watches[wd], dpath)
+
+			// the same watch is returned for every path of a directory;
+			// remove it only when none of them is watched anymore
+			if len(w.watches[wd]) == 0 {
+				syscall.InotifyRmWatch(w.fd, uint32(wd))
+				delete(w.watches, wd)
+			}
+		}
+	}
+
+	for dpath := range cur {
+		if _, ok := w.paths[dpath]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dpath, shareWatcherMask)
+		if err != nil {
+			log.Log(w.sm.client.conf.LogLevel, log.LevelInfo, "[share] unable to watch %s: %s", dpath, err)
+			continue
+		}
+		w.paths[dpath] = int32(wd)
+		if _, ok := w.watches[int32(wd)]; !ok {
+			w.watches[int32(wd)] = make(map[string]struct{})
+		}
+		w.watches[int32(wd)][dpath] = struct{}{}
+	}
+}
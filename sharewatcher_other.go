@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package dctk
+
+import (
+	"fmt"
+)
+
+type shareWatcher struct{}
+
+func newShareWatcher(sm *shareIndexer) (*shareWatcher, error) {
+	return nil, fmt.Errorf("share watching is not supported on this platform")
+}
+
+func (w *shareWatcher) close() {}
+
+func (w *shareWatcher) do() {}
+
+func (w *shareWatcher) sync(dpaths []string) {}
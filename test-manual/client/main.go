@@ -26,7 +26,7 @@ func main() {
 		client.ShareAdd("share", "/share")
 	}
 
-	client.OnShareIndexed = func() {
+	client.OnShareIndexed = func(dctk.ShareIndexSummary) {
 		client.HubConnect()
 	}
 
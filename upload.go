@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/go-dc/adc"
@@ -13,26 +14,32 @@ import (
 
 	"github.com/aler9/dctk/pkg/log"
 	"github.com/aler9/dctk/pkg/protoadc"
+	"github.com/aler9/dctk/pkg/protonmdc"
 	"github.com/aler9/dctk/pkg/tiger"
 )
 
 var errorNoSlots = fmt.Errorf("no slots available")
 
-type upload struct {
+// Upload represents a file upload to a peer.
+type Upload struct {
 	client             *Client
 	terminateRequested bool
 	state              string
 	pconn              *peerConn
+	peer               *Peer
 	reader             io.ReadCloser
 	isCompressed       bool
+	isMiniSlot         bool
+	isGranted          bool
 	query              string
 	start              uint64
 	length             uint64
-	offset             uint64
+	offset             uint64 // atomic
+	speed              uint64 // atomic
 	lastPrintTime      time.Time
 }
 
-func (*upload) isTransfer() {}
+func (*Upload) isTransfer() {}
 
 func newUpload(client *Client,
 	pconn *peerConn,
@@ -41,10 +48,11 @@ func newUpload(client *Client,
 	reqLength int64,
 	reqCompressed bool,
 ) bool {
-	u := &upload{
+	u := &Upload{
 		client:       client,
 		state:        "processing",
 		pconn:        pconn,
+		peer:         pconn.peer,
 		query:        reqQuery,
 		start:        reqStart,
 		isCompressed: (!client.conf.PeerDisableCompression && reqCompressed),
@@ -53,12 +61,12 @@ func newUpload(client *Client,
 	log.Log(client.conf.LogLevel, log.LevelInfo, "[upload] [%s] request %s (s=%d l=%d)",
 		pconn.peer.Nick, dcReadableQuery(u.query), u.start, reqLength)
 
-	err := func() error {
-		// check available slots
-		if u.client.uploadSlotAvail <= 0 {
-			return errorNoSlots
-		}
+	// file lists, tthl and small files can use a mini-slot
+	isSmall := false
 
+	var queuePos uint
+	var path string
+	err := func() error {
 		// upload is file list
 		if u.query == "file files.xml.bz2" {
 			if u.start != 0 || reqLength != -1 {
@@ -67,6 +75,7 @@ func newUpload(client *Client,
 
 			u.reader = io.NopCloser(bytes.NewReader(u.client.fileList))
 			u.length = uint64(len(u.client.fileList))
+			isSmall = true
 			return nil
 		}
 
@@ -83,38 +92,35 @@ func newUpload(client *Client,
 			return err
 		}
 
-		sfile := func() (ret *shareFile) {
-			var scanDir func(dir *shareDirectory) bool
-			scanDir = func(dir *shareDirectory) bool {
-				for _, file := range dir.files {
-					if file.tth == tth {
-						ret = file
-						return true
-					}
-				}
-				for _, sdir := range dir.dirs {
-					if scanDir(sdir) {
-						return true
-					}
-				}
-				return false
-			}
-			for _, dir := range u.client.shareTree {
-				if scanDir(dir) {
-					break
-				}
-			}
-			return
-		}()
+		sfile := u.client.shareFileByTTH(tth)
 		if sfile == nil {
 			return fmt.Errorf("file does not exists")
 		}
+		path = sfile.aliasPath
 
 		// upload is file tthl
 		if strings.HasPrefix(u.query, "tthl") {
 			if u.start != 0 || reqLength != -1 {
 				return fmt.Errorf("tthl seeking is not supported")
 			}
+			isSmall = true
+
+			// leaves are stored in the hash cache
+			if sfile.tthl == nil && u.client.hashCache != nil {
+				f, err := os.Open(u.client.hashCache.leavesPath(sfile.tth))
+				if err != nil {
+					return err
+				}
+				fi, err := f.Stat()
+				if err != nil {
+					f.Close()
+					return err
+				}
+				u.reader = f
+				u.length = uint64(fi.Size())
+				return nil
+			}
+
 			buf := bytes.NewBuffer(nil)
 			for _, leaf := range sfile.tthl {
 				buf.Write(leaf[:])
@@ -152,25 +158,86 @@ func newUpload(client *Client,
 		}
 
 		u.reader = f
+		isSmall = sfile.size <= u.client.conf.UploadMiniSlotSize
 		return nil
 	}()
+
+	// ask the authorizer
+	decision := UploadAllow
+	if err == nil && u.client.UploadAuthorizer != nil {
+		var msg string
+		decision, msg = u.client.UploadAuthorizer(&UploadRequest{
+			Peer:   pconn.peer,
+			Query:  u.query,
+			Path:   path,
+			Start:  u.start,
+			Length: u.length,
+		})
+		if decision == UploadDeny {
+			if msg == "" {
+				msg = "Access denied"
+			}
+			u.reader.Close()
+			err = uploadDeniedError{msg}
+		}
+	}
+
+	// check available slots
+	if err == nil {
+		if decision == UploadEnqueue {
+			queuePos = u.client.uploadQueueAdd(pconn.peer, u.query, true)
+			u.reader.Close()
+			err = errorNoSlots
+		} else if isSmall && u.client.uploadMiniSlotAvail > 0 {
+			u.isMiniSlot = true
+			u.client.uploadQueueRemove(pconn.peer, u.query)
+		} else if u.client.hasGrantedSlot(pconn.peer) {
+			u.isGranted = true
+			u.client.uploadQueueRemove(pconn.peer, u.query)
+		} else {
+			queuePos = u.client.uploadQueueCheck(pconn.peer, u.query)
+			if queuePos != 0 {
+				u.reader.Close()
+				err = errorNoSlots
+			}
+		}
+	}
+
 	if err != nil {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[peer] cannot start upload: %s", err)
 		if err == errorNoSlots {
-			if u.client.protoIsAdc() {
+			log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] queued at position %d",
+				pconn.peer.Nick, queuePos)
+			if u.pconn.protoIsAdc() {
+				u.pconn.conn.Write(&protoadc.AdcCStatusQueued{ //nolint:govet
+					&adc.ClientPacket{},
+					&protoadc.AdcStatusQueued{
+						Status: adc.Status{
+							Sev:  adc.Recoverable,
+							Code: protoadc.AdcCodeSlotsFull,
+							Msg:  "Slots full",
+						},
+						Position: int(queuePos),
+					},
+				})
+			} else {
+				u.pconn.conn.Write(&protonmdc.NmdcMaxedOut{Position: queuePos})
+			}
+		} else if derr, ok := err.(uploadDeniedError); ok {
+			if u.pconn.protoIsAdc() {
 				u.pconn.conn.Write(&protoadc.AdcCStatus{ //nolint:govet
 					&adc.ClientPacket{},
 					&adc.Status{
 						Sev:  adc.Recoverable,
-						Code: protoadc.AdcCodeSlotsFull,
-						Msg:  "Slots full",
+						Code: protoadc.AdcCodeTransferGeneric,
+						Msg:  derr.msg,
 					},
 				})
 			} else {
-				u.pconn.conn.Write(&nmdc.MaxedOut{})
+				u.pconn.conn.Write(&nmdc.Error{Err: fmt.Errorf("%s", derr.msg)})
 			}
 		} else {
-			if u.client.protoIsAdc() {
+			if u.pconn.protoIsAdc() {
 				u.pconn.conn.Write(&protoadc.AdcCStatus{ //nolint:govet
 					&adc.ClientPacket{},
 					&adc.Status{
@@ -186,7 +253,7 @@ func newUpload(client *Client,
 		return false
 	}
 
-	if u.client.protoIsAdc() {
+	if u.pconn.protoIsAdc() {
 		queryParts := strings.Split(u.query, " ")
 		u.pconn.conn.Write(&protoadc.AdcCSendFile{ //nolint:govet
 			&adc.ClientPacket{},
@@ -210,13 +277,66 @@ func newUpload(client *Client,
 	}
 
 	client.transfers[u] = struct{}{}
-	u.client.uploadSlotAvail--
+	switch {
+	case u.isMiniSlot:
+		u.client.uploadMiniSlotAvail--
+	case !u.isGranted:
+		u.client.uploadSlotAvail--
+	}
+	u.pconn.limiter.setRate(uint64(client.conf.UploadMaxSpeedPerPeer))
 	u.pconn.state = "delegated_upload"
 	u.pconn.transfer = u
+
+	if client.OnUploadStarted != nil {
+		client.OnUploadStarted(u)
+	}
 	return true
 }
 
-func (u *upload) Close() {
+// Uploads returns the uploads in progress.
+func (c *Client) Uploads() []*Upload {
+	var ret []*Upload
+	for t := range c.transfers {
+		if u, ok := t.(*Upload); ok {
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
+
+// Peer returns the peer that is receiving the upload.
+func (u *Upload) Peer() *Peer {
+	return u.peer
+}
+
+// Query returns the requested resource, in the form "file TTH/<tth>",
+// "tthl TTH/<tth>" or "file files.xml.bz2".
+func (u *Upload) Query() string {
+	return u.query
+}
+
+// Start returns the offset of the first byte that is uploaded.
+func (u *Upload) Start() uint64 {
+	return u.start
+}
+
+// Length returns the amount of bytes that are uploaded.
+func (u *Upload) Length() uint64 {
+	return u.length
+}
+
+// Offset returns the amount of bytes that have been uploaded.
+func (u *Upload) Offset() uint64 {
+	return atomic.LoadUint64(&u.offset)
+}
+
+// Speed returns the current upload speed, in bytes per second.
+func (u *Upload) Speed() uint64 {
+	return atomic.LoadUint64(&u.speed)
+}
+
+// Close stops the upload. OnUploadError and OnUploadFinished are not called.
+func (u *Upload) Close() {
 	if u.terminateRequested {
 		return
 	}
@@ -224,7 +344,7 @@ func (u *upload) Close() {
 	u.pconn.close()
 }
 
-func (u *upload) handleUpload() error {
+func (u *Upload) handleUpload() error {
 	u.pconn.conn.SetSyncMode(true)
 	if u.isCompressed {
 		u.pconn.conn.EnableWriterZlib()
@@ -234,11 +354,13 @@ func (u *upload) handleUpload() error {
 	buf := make([]byte, 1024*1024)
 	bufLength := uint64(len(buf))
 
+	offset := uint64(0)
+
 	for {
 		// apply length
 		maxLength := func() uint64 {
-			if (u.offset + bufLength) >= u.length {
-				return u.length - u.offset
+			if (offset + bufLength) >= u.length {
+				return u.length - offset
 			}
 			return bufLength
 		}()
@@ -251,18 +373,39 @@ func (u *upload) handleUpload() error {
 			return err
 		}
 
-		u.offset += uint64(n)
+		offset += uint64(n)
 
-		err = u.pconn.conn.WriteSync(buf[:n])
-		if err != nil {
-			return err
+		// write in chunks, in order to apply speed limits smoothly
+		for sent := 0; sent < n; {
+			end := sent + rateLimiterChunkSize
+			if end > n {
+				end = n
+			}
+
+			u.client.uploadLimiter.wait(end - sent)
+			u.pconn.limiter.wait(end - sent)
+
+			err = u.pconn.conn.WriteSync(buf[sent:end])
+			if err != nil {
+				return err
+			}
+			sent = end
 		}
 
+		atomic.StoreUint64(&u.offset, offset)
+
 		since := time.Since(u.lastPrintTime)
 		if since >= (1 * time.Second) {
 			u.lastPrintTime = time.Now()
-			speed := float64(u.pconn.conn.PullWriteCounter()) / 1024 / (float64(since) / float64(time.Second))
-			log.Log(u.client.conf.LogLevel, log.LevelInfo, "[sent] %d/%d (%.1f KiB/s)", u.offset, u.length, speed)
+			speed := float64(u.pconn.conn.PullWriteCounter()) / (float64(since) / float64(time.Second))
+			atomic.StoreUint64(&u.speed, uint64(speed))
+			log.Log(u.client.conf.LogLevel, log.LevelInfo, "[sent] %d/%d (%.1f KiB/s)", offset, u.length, speed/1024)
+
+			u.client.Safe(func() {
+				if u.client.OnUploadProgress != nil {
+					u.client.OnUploadProgress(u)
+				}
+			})
 		}
 	}
 
@@ -274,7 +417,7 @@ func (u *upload) handleUpload() error {
 	return nil
 }
 
-func (u *upload) handleExit(err error) {
+func (u *Upload) handleExit(err error) {
 	if !u.terminateRequested && err != nil {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "ERR (upload) [%s]: %s", u.pconn.peer.Nick, err)
 	}
@@ -283,7 +426,12 @@ func (u *upload) handleExit(err error) {
 
 	u.reader.Close()
 
-	u.client.uploadSlotAvail++
+	switch {
+	case u.isMiniSlot:
+		u.client.uploadMiniSlotAvail++
+	case !u.isGranted:
+		u.client.uploadSlotAvail++
+	}
 
 	if err == nil {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] finished %s (s=%d l=%d)",
@@ -292,4 +440,16 @@ func (u *upload) handleExit(err error) {
 		log.Log(u.client.conf.LogLevel, log.LevelInfo, "[upload] [%s] failed %s",
 			u.pconn.peer.Nick, dcReadableQuery(u.query))
 	}
+
+	if !u.terminateRequested {
+		if err == nil {
+			if u.client.OnUploadFinished != nil {
+				u.client.OnUploadFinished(u)
+			}
+		} else {
+			if u.client.OnUploadError != nil {
+				u.client.OnUploadError(u, err)
+			}
+		}
+	}
 }
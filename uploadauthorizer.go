@@ -0,0 +1,49 @@
+package dctk
+
+import (
+	"fmt"
+)
+
+// UploadDecision is the decision taken by an UploadAuthorizer.
+type UploadDecision int
+
+const (
+	// UploadAllow allows the upload, if a slot is available
+	UploadAllow UploadDecision = iota
+	// UploadDeny refuses the upload
+	UploadDeny
+	// UploadEnqueue puts the peer in the upload queue, even if a slot is available.
+	// The peer is placed after the peers waiting for a slot, and does not
+	// prevent them from using free slots
+	UploadEnqueue
+)
+
+// UploadRequest contains the details of an upload request, that are passed
+// to an UploadAuthorizer.
+type UploadRequest struct {
+	// the peer that requested the upload
+	Peer *Peer
+	// the requested resource, in the form "file TTH/<tth>", "tthl TTH/<tth>"
+	// or "file files.xml.bz2"
+	Query string
+	// the path of the requested file in the share, in the form "/alias/dir/file".
+	// It is empty when the file list is requested
+	Path string
+	// the offset of the first requested byte
+	Start uint64
+	// the amount of requested bytes
+	Length uint64
+}
+
+// UploadAuthorizer is a function that decides whether an upload can start.
+// When the upload is denied, the returned message is sent to the peer.
+type UploadAuthorizer func(req *UploadRequest) (UploadDecision, string)
+
+// uploadDeniedError is returned when an upload is denied by the UploadAuthorizer.
+type uploadDeniedError struct {
+	msg string
+}
+
+func (e uploadDeniedError) Error() string {
+	return fmt.Sprintf("denied: %s", e.msg)
+}
@@ -0,0 +1,134 @@
+package dctk
+
+import (
+	"time"
+)
+
+// UploadQueueEntry is a peer that is waiting for an upload slot.
+type UploadQueueEntry struct {
+	// the peer that requested the upload
+	Peer *Peer
+	// the last query sent by the peer
+	Query string
+	// when the peer entered the queue
+	Since time.Time
+	// when the peer sent its last request
+	LastRequest time.Time
+
+	held bool
+}
+
+// uploadQueueCheck is called when a peer requests an upload. It returns zero
+// if the upload can start, otherwise the position of the peer in the queue.
+// Free slots are granted to the peers that are waiting since the longest time,
+// when they request again.
+func (c *Client) uploadQueueCheck(peer *Peer, query string) uint {
+	c.uploadQueuePrune()
+
+	idx := c.uploadQueueIndex(peer)
+	if idx >= 0 && !c.uploadQueue[idx].held {
+		if uint(idx) < c.uploadSlotAvail {
+			c.uploadQueueDel(idx)
+			return 0
+		}
+	} else if uint(c.uploadQueueWaiting()) < c.uploadSlotAvail {
+		// the peer was held by the authorizer
+		if idx >= 0 {
+			c.uploadQueueDel(idx)
+		}
+		return 0
+	}
+
+	return c.uploadQueueAdd(peer, query, false)
+}
+
+// uploadQueueAdd puts a peer in the queue, or updates its entry, and returns
+// its position. Peers held by the authorizer can't use free slots, therefore
+// they are kept after the others, in order not to block them.
+func (c *Client) uploadQueueAdd(peer *Peer, query string, held bool) uint {
+	now := time.Now()
+	e := &UploadQueueEntry{Since: now}
+	idx := c.uploadQueueIndex(peer)
+	if idx >= 0 {
+		e = c.uploadQueue[idx]
+		if e.held != held {
+			c.uploadQueueDel(idx)
+			idx = -1
+		}
+	}
+
+	if idx < 0 {
+		idx = len(c.uploadQueue)
+		if !held {
+			idx = c.uploadQueueWaiting()
+		}
+		c.uploadQueue = append(c.uploadQueue, nil)
+		copy(c.uploadQueue[idx+1:], c.uploadQueue[idx:])
+		c.uploadQueue[idx] = e
+	}
+
+	e.Peer = peer
+	e.Query = query
+	e.LastRequest = now
+	e.held = held
+	return uint(idx + 1)
+}
+
+// uploadQueueWaiting returns the number of peers that are waiting for a free
+// slot, that are at the beginning of the queue.
+func (c *Client) uploadQueueWaiting() int {
+	for i, e := range c.uploadQueue {
+		if e.held {
+			return i
+		}
+	}
+	return len(c.uploadQueue)
+}
+
+func (c *Client) uploadQueueDel(idx int) {
+	c.uploadQueue = append(c.uploadQueue[:idx], c.uploadQueue[idx+1:]...)
+}
+
+func (c *Client) uploadQueueIndex(peer *Peer) int {
+	for i, e := range c.uploadQueue {
+		// peers are matched by nick, since they may have reconnected to the hub
+		if e.Peer.Hub == peer.Hub && e.Peer.Nick == peer.Nick {
+			return i
+		}
+	}
+	return -1
+}
+
+// uploadQueueRemove removes a peer from the queue, when the query it was
+// waiting for is served in another way.
+func (c *Client) uploadQueueRemove(peer *Peer, query string) {
+	idx := c.uploadQueueIndex(peer)
+	if idx >= 0 && c.uploadQueue[idx].Query == query {
+		c.uploadQueueDel(idx)
+	}
+}
+
+// uploadQueuePrune removes the peers that did not request again within
+// UploadQueueTimeout.
+func (c *Client) uploadQueuePrune() {
+	n := 0
+	for _, e := range c.uploadQueue {
+		if time.Since(e.LastRequest) < c.conf.UploadQueueTimeout {
+			c.uploadQueue[n] = e
+			n++
+		}
+	}
+	for i := n; i < len(c.uploadQueue); i++ {
+		c.uploadQueue[i] = nil
+	}
+	c.uploadQueue = c.uploadQueue[:n]
+}
+
+// UploadQueue returns the peers that are waiting for an upload slot,
+// ordered by waiting time. Peers held by UploadAuthorizer come last.
+func (c *Client) UploadQueue() []*UploadQueueEntry {
+	c.uploadQueuePrune()
+	ret := make([]*UploadQueueEntry, len(c.uploadQueue))
+	copy(ret, c.uploadQueue)
+	return ret
+}
@@ -0,0 +1,203 @@
+package dctk
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aler9/go-dc/adc"
+	"github.com/aler9/go-dc/nmdc"
+
+	"github.com/aler9/dctk/pkg/log"
+)
+
+// UserCommandContext contains the contexts in which a user command can be used.
+// Contexts can be combined together.
+type UserCommandContext int
+
+const (
+	// UserCommandContextHub means that the command refers to the hub
+	UserCommandContextHub UserCommandContext = 1 << iota
+	// UserCommandContextUser means that the command refers to a peer
+	UserCommandContextUser
+	// UserCommandContextSearch means that the command refers to a search result
+	UserCommandContextSearch
+	// UserCommandContextFileList means that the command refers to a file list entry
+	UserCommandContextFileList
+)
+
+// UserCommand is a command provided by a hub, that can be run with RunUserCommand().
+type UserCommand struct {
+	// the hub that provided the command
+	Hub *Hub
+	// the name of the command. Submenus are separated by a slash
+	Name string
+	// the contexts in which the command can be used
+	Context UserCommandContext
+	// the raw command template, containing placeholders in the format %[name]
+	Command string
+	// whether the command is just a separator in a menu
+	Separator bool
+	// whether the command must be run once even if multiple peers are selected
+	Constrained bool
+}
+
+var reUserCommandParam = regexp.MustCompile(`%\[([^\]]+)\]`)
+
+func (h *Hub) handleUserCommand(cmd *UserCommand) {
+	log.Log(h.client.conf.LogLevel, log.LevelDebug, "[hub] user command: %+v", cmd)
+
+	// a command with the same name replaces the existing one
+	for i, ocmd := range h.userCommands {
+		if ocmd.Name == cmd.Name && !cmd.Separator {
+			h.userCommands = append(h.userCommands[:i], h.userCommands[i+1:]...)
+			break
+		}
+	}
+	h.userCommands = append(h.userCommands, cmd)
+
+	if h.client.OnUserCommand != nil {
+		h.client.OnUserCommand(cmd)
+	}
+}
+
+func (h *Hub) handleAdcUserCommand(msg *adc.UserCommand) {
+	name := strings.Join(msg.Path, "/")
+
+	if msg.Remove != 0 {
+		for i, cmd := range h.userCommands {
+			if cmd.Name == name {
+				h.userCommands = append(h.userCommands[:i], h.userCommands[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	h.handleUserCommand(&UserCommand{
+		Hub:         h,
+		Name:        name,
+		Context:     UserCommandContext(msg.Category),
+		Command:     msg.Command,
+		Separator:   msg.Separator != 0,
+		Constrained: msg.Constrained != 0,
+	})
+}
+
+func (h *Hub) handleNmdcUserCommand(msg *nmdc.UserCommand) {
+	// erase all commands in the given contexts
+	if msg.Typ == nmdc.TypeErase {
+		var cmds []*UserCommand
+		for _, cmd := range h.userCommands {
+			if (cmd.Context & UserCommandContext(msg.Context)) == 0 {
+				cmds = append(cmds, cmd)
+			}
+		}
+		h.userCommands = cmds
+		return
+	}
+
+	h.handleUserCommand(&UserCommand{
+		Hub:         h,
+		Name:        strings.Join(msg.Path, "/"),
+		Context:     UserCommandContext(msg.Context),
+		Command:     msg.Command,
+		Separator:   msg.Typ == nmdc.TypeSeparator,
+		Constrained: msg.Typ == nmdc.TypeRawNickLimited,
+	})
+}
+
+// UserCommands returns the user commands provided by the hub.
+func (h *Hub) UserCommands() []*UserCommand {
+	return h.userCommands
+}
+
+// RunUserCommand runs a user command provided by a hub. Peer is the peer the
+// command refers to and can be nil if the command does not need it. Params
+// contains the values of the %[line:...] placeholders, indexed by their
+// description, and any additional placeholder.
+func (c *Client) RunUserCommand(cmd *UserCommand, peer *Peer, params map[string]string) error {
+	h := cmd.Hub
+	if h.state != hubInitialized {
+		return fmt.Errorf("hub is not connected")
+	}
+	if cmd.Separator {
+		return fmt.Errorf("command is a separator")
+	}
+	if peer != nil && peer.Hub != h {
+		return fmt.Errorf("peer does not belong to the hub of the command")
+	}
+
+	escape := func(in string) string {
+		if h.protoIsAdc() {
+			return strings.NewReplacer("\\", "\\\\", " ", "\\s", "\n", "\\n").Replace(in)
+		}
+		return strings.NewReplacer("$", "&#36;", "|", "&#124;").Replace(in)
+	}
+
+	var err error
+	out := reUserCommandParam.ReplaceAllStringFunc(cmd.Command, func(match string) string {
+		key := match[2 : len(match)-1]
+
+		if strings.HasPrefix(key, "line:") {
+			val, ok := params[key[len("line:"):]]
+			if !ok {
+				err = fmt.Errorf("missing parameter: %s", key[len("line:"):])
+				return match
+			}
+			return escape(val)
+		}
+
+		if val, ok := params[key]; ok {
+			return escape(val)
+		}
+
+		switch key {
+		case "myNI", "mynick":
+			return escape(h.nick)
+
+		case "mySID":
+			return h.adcSessionID.String()
+
+		case "myCID":
+			return c.clientID.String()
+		}
+
+		if peer == nil {
+			return match
+		}
+
+		switch key {
+		case "userNI", "nick":
+			return escape(peer.Nick)
+
+		case "userSID":
+			return peer.adcSessionID.String()
+
+		case "userCID":
+			return peer.adcClientID.String()
+
+		case "userI4", "ip":
+			return peer.IP
+		}
+
+		return match
+	})
+	if err != nil {
+		return err
+	}
+
+	if h.protoIsAdc() {
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+	} else {
+		if !strings.HasSuffix(out, "|") {
+			out += "|"
+		}
+	}
+
+	log.Log(c.conf.LogLevel, log.LevelInfo, "[hub] running user command: %s", cmd.Name)
+	h.conn.WriteRaw([]byte(out))
+	return nil
+}
@@ -90,3 +90,18 @@ func (rc *bytesWriteCloser) Write(in []byte) (int, error) {
 func (rc *bytesWriteCloser) Close() error {
 	return nil
 }
+
+// prefixedConn is a net.Conn that returns a prefix before the actual data.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(buf []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(buf, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(buf)
+}